@@ -0,0 +1,3 @@
+module github.com/yaccio/orchid/orchid-client
+
+go 1.24
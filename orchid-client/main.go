@@ -1,31 +1,43 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/gorilla/websocket"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 )
 
 type Settings struct {
 	ServerUrl string
+	Token     string
 }
 
 func Usage() {
 	fmt.Println(`
   The orchid-client sends commands to a running orchid-server.
-  
+
   "orchid-client <cmd>" will run the command on the remote orchid-server
   defined in the config file in the current dirrectory.
-  
+
+  The following commands are available:
+	  list <jobs|machines|actions|logs>
+	  run <job id> [<name>=<value> ...]
+	  show <log id>
+	  logs <log id>
+	  cancel <log id>
+
   remote.json configuration file format:
   {
-	  "ServerUrl": "ws://<url>"
+	  "ServerUrl": "http://<url>",
+	  "Token": "<token printed by orchid-server -token>"
   }
-  
+
   The following addition flags are available:
 	`)
 	flag.PrintDefaults()
@@ -56,33 +68,69 @@ func main() {
 	settings, err := loadSettings((*path))
 	errorHandle(err)
 
-	conn, err := connect(settings.ServerUrl)
-	errorHandle(err)
+	switch args[0] {
+	case "list":
+		errorHandle(request(settings, "GET", "/"+args[1], nil, os.Stdout))
+	case "run":
+		parameters := map[string]string{}
+		for _, arg := range args[2:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				errorHandle(errors.New("Invalid parameter '" + arg + "', expected <name>=<value>"))
+			}
+			parameters[parts[0]] = parts[1]
+		}
+		body, _ := json.Marshal(struct{ Parameters map[string]string }{parameters})
 
-	sendCommand(args[0]+" "+args[1], conn)
-	readMessages(conn)
+		var response struct{ LogId string }
+		errorHandle(requestJSON(settings, "POST", "/jobs/"+args[1]+"/run", body, &response))
+		fmt.Println(response.LogId)
+		errorHandle(request(settings, "GET", "/logs/"+response.LogId+"/output", nil, os.Stdout))
+	case "show":
+		errorHandle(request(settings, "GET", "/logs/"+args[1], nil, os.Stdout))
+	case "logs":
+		errorHandle(request(settings, "GET", "/logs/"+args[1]+"/output", nil, os.Stdout))
+	case "cancel":
+		errorHandle(request(settings, "POST", "/logs/"+args[1]+"/cancel", nil, os.Stdout))
+	default:
+		Usage()
+	}
 }
 
-func connect(url string) (*websocket.Conn, error) {
-	fmt.Println("Connecting to " + url)
-	conn, _, err := (&websocket.Dialer{}).Dial(url, http.Header{})
-	errorHandle(err)
+func request(settings Settings, method, path string, body []byte, out io.Writer) error {
+	fmt.Fprintln(os.Stderr, "Sending request: "+method+" "+path)
+	req, err := http.NewRequest(method, strings.TrimSuffix(settings.ServerUrl, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+settings.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
-	return conn, nil
-}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
 
-func sendCommand(command string, conn *websocket.Conn) {
-	fmt.Println("Sending command: " + command)
-	err := conn.WriteMessage(websocket.TextMessage, []byte(command))
-	errorHandle(err)
+	if res.StatusCode >= 300 {
+		var response struct{ Error string }
+		json.NewDecoder(res.Body).Decode(&response)
+		return errors.New(res.Status + ": " + response.Error)
+	}
+
+	_, err = io.Copy(out, res.Body)
+	return err
 }
 
-func readMessages(conn *websocket.Conn) {
-	_, p, err := conn.ReadMessage()
-	for err == nil {
-		fmt.Println(string(p))
-		_, p, err = conn.ReadMessage()
+func requestJSON(settings Settings, method, path string, body []byte, value interface{}) error {
+	var buffer bytes.Buffer
+	err := request(settings, method, path, body, &buffer)
+	if err != nil {
+		return err
 	}
+	return json.Unmarshal(buffer.Bytes(), value)
 }
 
 func errorHandle(err error) {
@@ -0,0 +1,233 @@
+/*
+Implementation of the HTTP/JSON API. Every request is served by running the
+Orchid command line interface, which is the single implementation of jobs,
+machines, actions and logs
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+/*
+Type defining the API
+*/
+type API struct {
+	token  string
+	secret string
+	queue  *Queue
+}
+
+/*
+Type defining the optional body of a request starting a job
+*/
+type RunRequest struct {
+	Parameters map[string]string
+}
+
+/*
+Type defining the response to a request starting a job
+*/
+type RunResponse struct {
+	LogId string
+}
+
+/*
+Type defining the response to a failed request
+*/
+type ErrorResponse struct {
+	Error string
+}
+
+/*
+Build the handler serving the API, requiring every request to be authenticated.
+Webhooks are authenticated by their signature instead of the bearer token
+*/
+func (api *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs", api.list("jobs"))
+	mux.HandleFunc("GET /machines", api.list("machines"))
+	mux.HandleFunc("GET /actions", api.list("actions"))
+	mux.HandleFunc("GET /logs", api.list("logs"))
+	mux.HandleFunc("POST /jobs/{id}/run", api.runJob)
+	mux.HandleFunc("GET /logs/{id}", api.showLog)
+	mux.HandleFunc("GET /logs/{id}/output", api.logOutput)
+	mux.HandleFunc("POST /logs/{id}/cancel", api.cancelLog)
+
+	root := http.NewServeMux()
+	root.HandleFunc("POST /webhook", api.webhook)
+	root.Handle("/", api.authenticate(mux))
+	return root
+}
+
+/*
+Wrap a handler, rejecting requests without the bearer token of the server
+*/
+func (api *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "Missing or invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+Build a handler listing the entities of the given kind
+*/
+func (api *API) list(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		api.writeOutput(w, http.StatusInternalServerError, "-json", "list", kind)
+	}
+}
+
+/*
+Queue the job with the given id and the parameters given in the body of the
+request, responding with the id of its log. The job runs once a worker is
+available and its limits allow it
+*/
+func (api *API) runJob(w http.ResponseWriter, r *http.Request) {
+	var request RunRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+
+	logId, status, err := api.queue.enqueue(r.PathValue("id"), request.Parameters, nil)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, RunResponse{LogId: logId})
+}
+
+/*
+Respond with the metadata of the log with the given id
+*/
+func (api *API) showLog(w http.ResponseWriter, r *http.Request) {
+	api.writeOutput(w, http.StatusNotFound, "-json", "show", r.PathValue("id"))
+}
+
+/*
+Stream the output of the log with the given id, until the job of the log has
+ended or the client disconnects
+*/
+func (api *API) logOutput(w http.ResponseWriter, r *http.Request) {
+	cmd := exec.CommandContext(r.Context(), "orchid", "logs", r.PathValue("id"))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer cmd.Wait()
+
+	flusher, _ := w.(http.Flusher)
+	scanner := bufio.NewScanner(stdout)
+	first := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if first {
+			first = false
+			if strings.HasPrefix(line, "ERROR: ") {
+				writeError(w, http.StatusNotFound, strings.TrimPrefix(line, "ERROR: "))
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+		}
+
+		_, err = io.WriteString(w, line+"\n")
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+/*
+Cancel the running job of the log with the given id
+*/
+func (api *API) cancelLog(w http.ResponseWriter, r *http.Request) {
+	output, err := api.command("cancel", r.PathValue("id")).CombinedOutput()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, commandError(output, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Run the command line interface with the given arguments, responding with its
+JSON output. Errors reported by the command line interface are responded to
+with the given status
+*/
+func (api *API) writeOutput(w http.ResponseWriter, errorStatus int, args ...string) {
+	output, err := api.command(args...).Output()
+	if err != nil || bytes.HasPrefix(output, []byte("ERROR: ")) {
+		writeError(w, errorStatus, commandError(output, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(output)
+}
+
+/*
+Build a command running the command line interface with the given arguments
+*/
+func (api *API) command(args ...string) *exec.Cmd {
+	return exec.Command("orchid", args...)
+}
+
+/*
+Get the error message of a failed command from its output
+*/
+func commandError(output []byte, err error) string {
+	message := strings.TrimSpace(string(output))
+	if i := strings.Index(message, "ERROR: "); i >= 0 {
+		return strings.TrimSpace(strings.SplitN(message[i+len("ERROR: "):], "\n", 2)[0])
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return message
+}
+
+/*
+Write a value as a JSON response with the given status
+*/
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+/*
+Write an error as a JSON response with the given status
+*/
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: message})
+}
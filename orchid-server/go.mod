@@ -0,0 +1,19 @@
+module github.com/yaccio/orchid/orchid-server
+
+go 1.24
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/robfig/cron v1.2.0
+	github.com/yaccio/orchid/orchid v0.0.0-00010101000000-000000000000
+	gopkg.in/fsnotify.v1 v1.4.7
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.35.0 // indirect
+
+// gopkg.in/fsnotify.v1 is the old import path of github.com/fsnotify/fsnotify
+replace gopkg.in/fsnotify.v1 => github.com/fsnotify/fsnotify v1.4.9
+
+// The server shares the types of the command line interface in the same repository
+replace github.com/yaccio/orchid/orchid => ../orchid
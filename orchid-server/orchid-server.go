@@ -1,34 +1,63 @@
+/*
+The Orchid CI server, exposing the Orchid command line interface through an
+authenticated HTTP/JSON API
+*/
+
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
-	"strings"
 )
 
 /*
 Application entry point
-Reads a line from stdin and passes it as arguments to the orchid application
+Loads the server configuration from the orchid directory, which is also used by
+the command line interface, and serves the API at the configured address
 */
 func main() {
-	buffer := bufio.NewReader(os.Stdin)
-	line, _, err := buffer.ReadLine()
+	var printToken bool
+	flag.BoolVar(&printToken, "token", false, "Print the API token derived from the server secret and exit")
+	flag.Parse()
+
+	server, err := loadServer("orchid")
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
 		os.Exit(1)
 	}
 
+	if printToken {
+		fmt.Println(apiToken(server.Secret))
+		return
+	}
+
 	os.Setenv("PATH", "/bin:/usr/bin")
 
-	args := strings.Fields(string(line))
+	api := &API{
+		token:  apiToken(server.Secret),
+		secret: server.Secret,
+	}
 
-	cmd := exec.Command("orchid", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	api.queue = newQueue(api, server.Workers)
+	err = api.queue.start()
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		os.Exit(1)
+	}
+
+	err = api.startTriggers()
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		os.Exit(1)
+	}
 
-	if err = cmd.Run(); err != nil {
+	address := net.JoinHostPort(server.Address, server.Port)
+	fmt.Println("Listening on " + address)
+	err = http.ListenAndServe(address, api.Handler())
+	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
 		os.Exit(1)
 	}
@@ -0,0 +1,191 @@
+/*
+Implementation of the job queue, running queued jobs on a pool of workers
+while respecting the maximum number of concurrent jobs of each job and machine
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yaccio/orchid/orchid/shared"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Type defining the queue. The queue itself is persisted by the command line
+interface as logs with the status Queued, so it is recovered when the server
+is restarted
+*/
+type Queue struct {
+	api     *API
+	workers int
+	mutex   sync.Mutex
+	changed *sync.Cond
+	items   []shared.QueuedJob
+	running map[string]int
+}
+
+/*
+Create a queue run by the given number of workers
+*/
+func newQueue(api *API, workers int) *Queue {
+	queue := &Queue{
+		api:     api,
+		workers: workers,
+		running: map[string]int{},
+	}
+	queue.changed = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+/*
+Recover the jobs queued before the server was restarted, in the order they
+were queued, and start the workers
+*/
+func (q *Queue) start() error {
+	var queued []shared.QueuedJob
+	err := q.api.loadJSON(&queued, "list", "queue")
+	if err != nil {
+		return err
+	}
+
+	for _, item := range queued {
+		q.push(item)
+	}
+
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+	return nil
+}
+
+/*
+Queue a job through the command line interface, which records the queued job
+in a new log along with its parameters and the event causing it to run, and
+add it to the queue along with the limits the command line interface found it
+subject to. The id of the log is returned. On failure the status to respond
+with is returned along with the error
+*/
+func (q *Queue) enqueue(jobId string, parameters map[string]string, event *shared.Event) (string, int, error) {
+	args := []string{"-json"}
+	if event != nil {
+		eventJSON, _ := json.Marshal(event)
+		args = append(args, "-event", string(eventJSON))
+	}
+	args = append(args, "queue", jobId)
+
+	names := []string{}
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, name+"="+parameters[name])
+	}
+
+	var item shared.QueuedJob
+	output, err := q.api.command(args...).Output()
+	if err != nil || json.Unmarshal(output, &item) != nil || item.LogId == "" {
+		return "", http.StatusBadRequest, errors.New(commandError(output, err))
+	}
+
+	q.push(item)
+	return item.LogId, 0, nil
+}
+
+/*
+Add a queued job to the queue
+*/
+func (q *Queue) push(item shared.QueuedJob) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.items = append(q.items, item)
+	q.changed.Broadcast()
+}
+
+/*
+Run queued jobs one at a time until the server stops. The output of the jobs
+is discarded, as it is stored in their logs
+*/
+func (q *Queue) work() {
+	for {
+		item := q.next()
+
+		start := time.Now()
+		err := q.api.command("start", item.LogId).Run()
+		if err != nil {
+			fmt.Printf("ERROR: Failed to run log %s: %s\n", item.LogId, err.Error())
+		} else {
+			fmt.Printf("Ran job %s in %s: %s\n", item.JobId, time.Since(start).Round(time.Second), item.LogId)
+		}
+
+		q.finish(item)
+	}
+}
+
+/*
+Take the first queued job that can run without exceeding any of its limits off
+the queue, waiting until there is one
+*/
+func (q *Queue) next() shared.QueuedJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		for i, item := range q.items {
+			if !q.allowed(item) {
+				continue
+			}
+
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			for key := range item.Limits {
+				q.running[key]++
+			}
+			return item
+		}
+		q.changed.Wait()
+	}
+}
+
+/*
+Check whether the queued job can run without exceeding any of its limits
+*/
+func (q *Queue) allowed(item shared.QueuedJob) bool {
+	for key, max := range item.Limits {
+		if q.running[key] >= max {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Record that a job has ended, allowing jobs waiting for it to run
+*/
+func (q *Queue) finish(item shared.QueuedJob) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for key := range item.Limits {
+		q.running[key]--
+	}
+	q.changed.Broadcast()
+}
+
+/*
+Run the command line interface with the given arguments, decoding its JSON
+output into the value
+*/
+func (api *API) loadJSON(value interface{}, args ...string) error {
+	output, err := api.command(append([]string{"-json"}, args...)...).Output()
+	if err != nil || len(output) == 0 || (output[0] != '[' && output[0] != '{') {
+		return fmt.Errorf("Failed to %s: %s", strings.Join(args, " "), commandError(output, err))
+	}
+	return json.Unmarshal(output, value)
+}
@@ -0,0 +1,122 @@
+/*
+Implementation of the scheduler running schedule triggers, keeping the time
+each schedule was last run so runs missed while the server was not running can
+be caught up
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/robfig/cron"
+	"github.com/yaccio/orchid/orchid/shared"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Type defining the times the schedules were last run, stored in the
+schedules.state file
+*/
+type ScheduleState struct {
+	mutex sync.Mutex
+	path  string
+	times map[string]time.Time
+}
+
+/*
+Load the times the schedules were last run. The state file is created once a
+schedule has run
+*/
+func loadScheduleState(path string) (*ScheduleState, error) {
+	state := &ScheduleState{
+		path:  path + "/schedules.state",
+		times: map[string]time.Time{},
+	}
+
+	data, err := ioutil.ReadFile(state.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &state.times)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+/*
+Get the time the schedule with the given key was last run
+*/
+func (s *ScheduleState) last(key string) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.times[key]
+}
+
+/*
+Record the time the schedule with the given key was run, writing the state to
+a temporary file which is renamed over the state file
+*/
+func (s *ScheduleState) record(key string, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.times[key] = at
+	data, err := json.MarshalIndent(s.times, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(s.path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+/*
+Run the job of a schedule trigger every time the schedule fires in the
+timezone of the trigger. If the schedule fired while the server was not
+running, it is run once when the server starts if its missed run policy is to
+catch up, and skipped otherwise
+*/
+func (api *API) runSchedule(trigger shared.Trigger, schedule cron.Schedule, location *time.Location, state *ScheduleState) {
+	key := trigger.ScheduleKey()
+	event := shared.Event{Type: "schedule", Schedule: trigger.Schedule.Cron}
+
+	last := state.last(key)
+	now := time.Now().In(location)
+	if !last.IsZero() && trigger.Schedule.Missed == "catchup" {
+		missed := schedule.Next(last.In(location))
+		if !missed.After(now) {
+			fmt.Printf("Catching up on run of %s missed at %s\n", trigger.Target(), missed.Format(time.RFC3339))
+			api.runScheduled(trigger, event, key, now, state)
+		}
+	}
+
+	for {
+		next := schedule.Next(time.Now().In(location))
+		time.Sleep(time.Until(next))
+		api.runScheduled(trigger, event, key, next, state)
+	}
+}
+
+/*
+Run the job of a schedule trigger, recording the time it was run
+*/
+func (api *API) runScheduled(trigger shared.Trigger, event shared.Event, key string, at time.Time, state *ScheduleState) {
+	api.runTrigger(trigger, event)
+
+	err := state.record(key, at)
+	if err != nil {
+		fmt.Println("ERROR: Failed to record schedule state: " + err.Error())
+	}
+}
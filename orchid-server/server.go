@@ -0,0 +1,134 @@
+/*
+Definition of and methods for loading and validating the server configuration
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+The number of workers running queued jobs if not configured
+*/
+const defaultWorkers = 4
+
+/*
+Type defining the server configuration, shared with the Orchid command line
+interface
+*/
+type Server struct {
+	Address string
+	Port    string
+	Secret  string
+	Workers int
+}
+
+/*
+Load the server configuration
+*/
+func loadServer(path string) (Server, error) {
+	server := &Server{}
+	data, err := readServerConfig(path)
+	if err != nil {
+		return Server{}, err
+	}
+
+	err = json.Unmarshal(data, &server)
+	if err != nil {
+		return Server{}, err
+	}
+
+	err = validateServer(*server)
+	if err != nil {
+		return Server{}, err
+	}
+	if server.Workers == 0 {
+		server.Workers = defaultWorkers
+	}
+
+	return *server, nil
+}
+
+/*
+Read the server configuration as JSON. Like the other configuration files, it
+may be written in YAML or TOML instead of JSON, but must not exist in more than
+one format. Values other than the number of workers are read as strings, so
+ports may be written without quotes
+*/
+func readServerConfig(path string) ([]byte, error) {
+	found := []string{}
+	for _, extension := range []string{".json", ".yaml", ".yml", ".toml"} {
+		if _, err := os.Stat(path + "/server" + extension); err == nil {
+			found = append(found, "server"+extension)
+		}
+	}
+	if len(found) == 0 {
+		return ioutil.ReadFile(path + "/server.json")
+	}
+	if len(found) > 1 {
+		return nil, errors.New("Server config invalid: Configuration given in more than one format: '" + strings.Join(found, "', '") + "'")
+	}
+
+	data, err := ioutil.ReadFile(path + "/" + found[0])
+	if err != nil || filepath.Ext(found[0]) == ".json" {
+		return data, err
+	}
+
+	config := map[string]interface{}{}
+	if filepath.Ext(found[0]) == ".toml" {
+		_, err = toml.Decode(string(data), &config)
+	} else {
+		err = yaml.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return nil, errors.New("Server config invalid: " + err.Error())
+	}
+
+	for key, value := range config {
+		if _, isString := value.(string); !isString && !strings.EqualFold(key, "Workers") {
+			config[key] = fmt.Sprint(value)
+		}
+	}
+	return json.Marshal(config)
+}
+
+/*
+Validate the server configuration. Unlike the command line interface, the
+server cannot run without a secret
+*/
+func validateServer(server Server) error {
+	if server.Port == "" {
+		return errors.New("Server config invalid: Server must have a non-empty Port")
+	}
+	if server.Secret == "" {
+		return errors.New("Server config invalid: Server must have a non-empty Secret")
+	}
+	if server.Workers < 0 {
+		return errors.New("Server config invalid: Server must not have a negative number of Workers")
+	}
+
+	return nil
+}
+
+/*
+Derive the bearer token required by the API from the server secret. The token
+is derived rather than being the secret itself, so the secret used for signing
+webhooks is never sent over the wire
+*/
+func apiToken(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("orchid-api-token"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
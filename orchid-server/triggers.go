@@ -0,0 +1,242 @@
+/*
+Evaluation of the triggers configured in the setup, running jobs on schedules,
+on the completion of other jobs, and on changes to watched directories.
+Webhook triggers are evaluated when a webhook is received
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/robfig/cron"
+	"github.com/yaccio/orchid/orchid/shared"
+	"gopkg.in/fsnotify.v1"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+The interval at which the logs are checked for completed jobs
+*/
+const completionInterval = 5 * time.Second
+
+/*
+The time to wait for further changes to a watched directory before running the
+job, so a burst of changes runs it only once
+*/
+const watchDelay = time.Second
+
+/*
+Load the triggers through the command line interface, which validates them
+*/
+func (api *API) loadTriggers() ([]shared.Trigger, error) {
+	var triggers []shared.Trigger
+	err := api.loadJSON(&triggers, "list", "triggers")
+	return triggers, err
+}
+
+/*
+Queue the job of a trigger because of an event, passing the parameters of the
+trigger. The id of the log of the job is returned, or an empty id if the
+trigger runs an action
+*/
+func (api *API) runTrigger(trigger shared.Trigger, event shared.Event) (string, int, error) {
+	if trigger.Action != "" {
+		api.runAction(trigger.Action, event)
+		return "", 0, nil
+	}
+
+	logId, status, err := api.queue.enqueue(trigger.Job, trigger.Parameters, &event)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to queue job %s on %s event: %s\n", trigger.Job, event.Type, err.Error())
+	} else {
+		fmt.Printf("Queued job %s on %s event: %s\n", trigger.Job, event.Type, logId)
+	}
+	return logId, status, err
+}
+
+/*
+Run an action in the background because of an event, printing its output if it
+fails
+*/
+func (api *API) runAction(actionId string, event shared.Event) {
+	fmt.Printf("Running action %s on %s event\n", actionId, event.Type)
+	go func() {
+		output, err := api.command("exec", actionId).CombinedOutput()
+		if err != nil {
+			fmt.Printf("ERROR: Action %s failed: %s\n%s", actionId, err.Error(), output)
+		}
+	}()
+}
+
+/*
+Start evaluating the schedule, completion and watch triggers in the background.
+The triggers are loaded once, so the server must be restarted for changes to
+these triggers to take effect
+*/
+func (api *API) startTriggers() error {
+	triggers, err := api.loadTriggers()
+	if err != nil {
+		return err
+	}
+
+	state, err := loadScheduleState("orchid")
+	if err != nil {
+		return err
+	}
+
+	after := []shared.Trigger{}
+	for _, trigger := range triggers {
+		if trigger.Schedule != nil {
+			schedule, err := cron.ParseStandard(trigger.Schedule.Cron)
+			if err != nil {
+				return err
+			}
+			location, err := trigger.Schedule.Location()
+			if err != nil {
+				return err
+			}
+			go api.runSchedule(trigger, schedule, location, state)
+		}
+		if trigger.After != nil {
+			after = append(after, trigger)
+		}
+		if trigger.Watch != nil {
+			watcher, err := newWatcher(trigger.Watch.Directory)
+			if err != nil {
+				return err
+			}
+			go api.runWatch(trigger, watcher)
+		}
+	}
+
+	if len(after) > 0 {
+		go api.runAfter(after)
+	}
+	return nil
+}
+
+/*
+Run the jobs of completion triggers by checking the logs for jobs that have
+completed at a regular interval. Jobs that completed before the server started
+are ignored
+*/
+func (api *API) runAfter(triggers []shared.Trigger) {
+	var seen map[string]bool
+	for {
+		logs, err := api.loadLogs()
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			time.Sleep(completionInterval)
+			continue
+		}
+
+		completed := []shared.Log{}
+		if seen == nil {
+			seen = map[string]bool{}
+		} else {
+			for _, log := range logs {
+				if log.Done() && !seen[log.Id] {
+					completed = append(completed, log)
+				}
+			}
+		}
+		for _, log := range logs {
+			if log.Done() {
+				seen[log.Id] = true
+			}
+		}
+
+		for _, log := range completed {
+			for _, trigger := range triggers {
+				if trigger.After.Job != log.JobId {
+					continue
+				}
+				if trigger.After.Status != "" && trigger.After.Status != log.Status {
+					continue
+				}
+				api.runTrigger(trigger, shared.Event{Type: "after", JobId: log.JobId, LogId: log.Id, Status: log.Status})
+			}
+		}
+
+		time.Sleep(completionInterval)
+	}
+}
+
+/*
+Load the logs through the command line interface
+*/
+func (api *API) loadLogs() ([]shared.Log, error) {
+	var logs []shared.Log
+	err := api.loadJSON(&logs, "list", "logs")
+	return logs, err
+}
+
+/*
+Create a watcher of a directory and all directories within it
+*/
+func newWatcher(directory string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return watcher, nil
+}
+
+/*
+Run the job of a watch trigger when files matching its pattern change. The job
+is run once no further changes have occurred for a while
+*/
+func (api *API) runWatch(trigger shared.Trigger, watcher *fsnotify.Watcher) {
+	timer := time.NewTimer(watchDelay)
+	timer.Stop()
+	changed := ""
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			// Watch directories created within the watched directory as well
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watcher.Add(event.Name)
+				}
+			}
+
+			if trigger.Watch.Pattern != "" {
+				matched, _ := filepath.Match(trigger.Watch.Pattern, filepath.Base(event.Name))
+				if !matched {
+					continue
+				}
+			}
+			changed = event.Name
+			timer.Reset(watchDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Println("ERROR: Failed to watch " + trigger.Watch.Directory + ": " + err.Error())
+		case <-timer.C:
+			api.runTrigger(trigger, shared.Event{Type: "watch", Path: changed})
+		}
+	}
+}
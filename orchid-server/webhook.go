@@ -0,0 +1,174 @@
+/*
+Implementation of the GitHub compatible webhook endpoint, running the jobs of
+the webhook triggers matching a push or pull request event
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/yaccio/orchid/orchid/shared"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+The maximum size of a webhook payload accepted, which is the limit GitHub
+applies as well
+*/
+const maxPayloadSize = 25 * 1024 * 1024
+
+/*
+Type defining the fields used of a push or pull request payload
+*/
+type Payload struct {
+	Ref        string
+	After      string
+	Deleted    bool
+	Action     string
+	Number     int
+	Repository struct {
+		FullName string `json:"full_name"`
+	}
+	PullRequest struct {
+		Head struct{ Sha string }
+		Base struct{ Ref string }
+	} `json:"pull_request"`
+}
+
+/*
+Type defining the response to a webhook, listing the logs of the jobs started
+and the errors of the matching triggers that failed to start their jobs
+*/
+type WebhookResponse struct {
+	LogIds []string
+	Errors []string `json:",omitempty"`
+}
+
+/*
+Handle a webhook, verifying its signature and running the jobs of all matching
+triggers
+*/
+func (api *API) webhook(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	if !validSignature(api.secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		writeError(w, http.StatusUnauthorized, "Missing or invalid signature")
+		return
+	}
+
+	eventType := r.Header.Get("X-GitHub-Event")
+	if eventType == "ping" {
+		writeJSON(w, http.StatusOK, WebhookResponse{LogIds: []string{}})
+		return
+	}
+	if eventType != "push" && eventType != "pull_request" {
+		writeError(w, http.StatusBadRequest, "Unsupported event '"+eventType+"'")
+		return
+	}
+
+	var payload Payload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid payload: "+err.Error())
+		return
+	}
+
+	event, ok := parseEvent(eventType, payload)
+	if !ok {
+		// Events such as deleted branches or closed pull requests run nothing
+		writeJSON(w, http.StatusOK, WebhookResponse{LogIds: []string{}})
+		return
+	}
+
+	triggers, err := api.loadTriggers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// A trigger failing to start its job does not stop the other triggers,
+	// and the logs of the jobs started are always listed, so a sender
+	// retrying the webhook can tell which jobs already run
+	response := WebhookResponse{LogIds: []string{}}
+	failure := 0
+	for _, trigger := range triggers {
+		if trigger.Webhook == nil || !trigger.Webhook.Matches(event) {
+			continue
+		}
+
+		logId, status, err := api.runTrigger(trigger, event)
+		if err != nil {
+			response.Errors = append(response.Errors, "Job '"+trigger.Job+"': "+err.Error())
+			if failure == 0 {
+				failure = status
+			}
+			continue
+		}
+		response.LogIds = append(response.LogIds, logId)
+	}
+
+	// The request only fails if no job was started
+	if len(response.LogIds) == 0 && failure != 0 {
+		writeJSON(w, failure, response)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+/*
+Verify the signature of a payload, given as "sha256=<hex HMAC>" using the
+server secret as key
+*/
+func validSignature(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+/*
+Build the event of a push or pull request payload. False is returned if the
+payload does not describe new commits to run jobs for
+*/
+func parseEvent(eventType string, payload Payload) (shared.Event, bool) {
+	event := shared.Event{
+		Type:       eventType,
+		Repository: payload.Repository.FullName,
+	}
+
+	if eventType == "push" {
+		if payload.Deleted || !strings.HasPrefix(payload.Ref, "refs/heads/") {
+			return shared.Event{}, false
+		}
+		event.Ref = payload.Ref
+		event.Branch = strings.TrimPrefix(payload.Ref, "refs/heads/")
+		event.Commit = payload.After
+		return event, true
+	}
+
+	if payload.Action != "opened" && payload.Action != "synchronize" && payload.Action != "reopened" {
+		return shared.Event{}, false
+	}
+	// Pull requests are matched against the branch they are to be merged into
+	event.Ref = "refs/pull/" + strconv.Itoa(payload.Number) + "/head"
+	event.Branch = payload.PullRequest.Base.Ref
+	event.Commit = payload.PullRequest.Head.Sha
+	return event, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/yaccio/orchid/orchid/shared"
+	"testing"
+)
+
+/*
+Sign a payload the way GitHub does, using the given secret as key
+*/
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	cases := []struct {
+		name      string
+		signature string
+		expected  bool
+	}{
+		{"good", sign("secret", body), true},
+		{"wrong secret", sign("other", body), false},
+		{"other body", sign("secret", []byte(`{"ref":"refs/heads/dev"}`)), false},
+		{"missing", "", false},
+		{"without prefix", sign("secret", body)[len("sha256="):], false},
+		{"sha1 prefix", "sha1=" + sign("secret", body)[len("sha256="):], false},
+		{"not hex", "sha256=xyz", false},
+	}
+	for _, c := range cases {
+		if actual := validSignature("secret", body, c.signature); actual != c.expected {
+			t.Errorf("Expected the %s signature to be valid: %t, got %t", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	push := `{"ref":"refs/heads/%s","after":"abc","repository":{"full_name":"yaccio/orchid"}}`
+	pullRequest := `{"action":"%s","number":7,"repository":{"full_name":"yaccio/orchid"},"pull_request":{"head":{"sha":"def"},"base":{"ref":"main"}}}`
+
+	cases := []struct {
+		eventType string
+		payload   string
+		value     string
+		trigger   shared.WebhookTrigger
+		expected  bool
+	}{
+		{"push", push, "main", shared.WebhookTrigger{}, true},
+		{"push", push, "main", shared.WebhookTrigger{Repository: "yaccio/orchid", Event: "push", Branch: "main"}, true},
+		{"push", push, "main", shared.WebhookTrigger{Repository: "yaccio/other"}, false},
+		{"push", push, "main", shared.WebhookTrigger{Event: "pull_request"}, false},
+		{"push", push, "dev", shared.WebhookTrigger{Branch: "main"}, false},
+		{"push", push, "release/1.0", shared.WebhookTrigger{Branch: "release/*"}, true},
+		{"push", push, "release/1.0/hotfix", shared.WebhookTrigger{Branch: "release/*"}, false},
+		{"push", push, "release/1.0/hotfix", shared.WebhookTrigger{Branch: "release/**"}, true},
+		{"push", push, "feature/a/b", shared.WebhookTrigger{Branch: "**/b"}, true},
+		{"push", push, "feature-1", shared.WebhookTrigger{Branch: "feature-?"}, true},
+		{"push", push, "feature/1", shared.WebhookTrigger{Branch: "feature?1"}, false},
+		{"push", push, "v2", shared.WebhookTrigger{Branch: "v[0-9]"}, true},
+		{"push", push, "main", shared.WebhookTrigger{Branch: "[main"}, false},
+		{"pull_request", pullRequest, "opened", shared.WebhookTrigger{Event: "pull_request", Branch: "main"}, true},
+		{"pull_request", pullRequest, "synchronize", shared.WebhookTrigger{Branch: "ma**"}, true},
+		{"pull_request", pullRequest, "opened", shared.WebhookTrigger{Event: "push"}, false},
+		{"pull_request", pullRequest, "opened", shared.WebhookTrigger{Branch: "dev"}, false},
+	}
+	for _, c := range cases {
+		var payload Payload
+		if err := json.Unmarshal([]byte(fmt.Sprintf(c.payload, c.value)), &payload); err != nil {
+			t.Fatal(err)
+		}
+		event, ok := parseEvent(c.eventType, payload)
+		if !ok {
+			t.Fatalf("Expected the %s event of %s to run jobs", c.eventType, c.value)
+		}
+		if actual := c.trigger.Matches(event); actual != c.expected {
+			t.Errorf("Expected %+v to match the %s event of %s: %t, got %t", c.trigger, c.eventType, c.value, c.expected, actual)
+		}
+	}
+}
+
+func TestParseEventIgnored(t *testing.T) {
+	cases := []struct {
+		eventType string
+		payload   string
+	}{
+		{"push", `{"ref":"refs/heads/main","deleted":true}`},
+		{"push", `{"ref":"refs/tags/v1.0"}`},
+		{"pull_request", `{"action":"closed","pull_request":{"base":{"ref":"main"}}}`},
+		{"pull_request", `{"action":"labeled","pull_request":{"base":{"ref":"main"}}}`},
+	}
+	for _, c := range cases {
+		var payload Payload
+		if err := json.Unmarshal([]byte(c.payload), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := parseEvent(c.eventType, payload); ok {
+			t.Errorf("Expected the %s event %s to run nothing", c.eventType, c.payload)
+		}
+	}
+}
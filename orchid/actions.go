@@ -5,16 +5,24 @@ Implementation of the Api for executing commands locally
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/hpcloud/tail"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type Actions struct {
 	path string
+	json bool
 }
 
 /*
@@ -24,12 +32,36 @@ func (a *Actions) ListJobs() {
 	setup, err := loadSetup(a.path)
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if a.json {
+		printJSON(setup.Jobs)
+		return
 	}
 
 	for _, job := range setup.Jobs {
 		fmt.Println(job.Id)
-		for _, ex := range job.Pipeline {
-			fmt.Printf("\t%s -> %s %v\n", ex.Machine, ex.Script, ex.Args)
+		if job.Matrix != nil {
+			for _, values := range job.Matrix.expand() {
+				fmt.Printf("\tvariant %s\n", variantId(values))
+			}
+		}
+		for i, ex := range job.Pipeline {
+			fmt.Printf("\t%s: %s -> %s %v", stepId(i, ex), ex.Machine, ex.Script, ex.Args)
+			if len(ex.Needs) > 0 {
+				fmt.Printf(" (needs %s)", strings.Join(ex.Needs, ", "))
+			}
+			if ex.When != "" {
+				fmt.Printf(" (when %s)", ex.When)
+			}
+			fmt.Println()
+		}
+		for i, ex := range job.OnFailure {
+			fmt.Printf("\ton failure %s: %s -> %s %v\n", stepId(i, ex), ex.Machine, ex.Script, ex.Args)
+		}
+		for i, ex := range job.Finally {
+			fmt.Printf("\tfinally %s: %s -> %s %v\n", stepId(i, ex), ex.Machine, ex.Script, ex.Args)
 		}
 	}
 }
@@ -41,6 +73,12 @@ func (a *Actions) ListActions() {
 	setup, err := loadSetup(a.path)
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if a.json {
+		printJSON(setup.Actions)
+		return
 	}
 
 	for _, action := range setup.Actions {
@@ -59,14 +97,168 @@ func (a *Actions) ListMachines() {
 	setup, err := loadSetup(a.path)
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if a.json {
+		printJSON(setup.Machines)
+		return
 	}
 
 	for _, machine := range setup.Machines {
 		fmt.Println(machine.Id)
 		fmt.Printf("\t%s@%s:%s (%s)\n", machine.User, machine.Address, machine.Port, machine.PrivateKey)
+		if len(machine.Tags) > 0 {
+			fmt.Printf("\ttags: %s\n", strings.Join(machine.Tags, ", "))
+		}
+	}
+}
+
+/*
+List all groups of machines
+*/
+func (a *Actions) ListGroups() {
+	setup, err := loadSetup(a.path)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if a.json {
+		printJSON(setup.Groups)
+		return
+	}
+
+	for _, group := range setup.Groups {
+		fmt.Println(group.Id)
+		fmt.Printf("\t%s\n", strings.Join(group.Machines, ", "))
+	}
+}
+
+/*
+List all triggers
+*/
+func (a *Actions) ListTriggers() {
+	setup, err := loadSetup(a.path)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if a.json {
+		printJSON(setup.Triggers)
+		return
+	}
+
+	for _, trigger := range setup.Triggers {
+		fmt.Println(trigger.Target())
+		if trigger.Webhook != nil {
+			fmt.Printf("\twebhook %s %s %s\n",
+				orAny(trigger.Webhook.Repository),
+				orAny(trigger.Webhook.Event),
+				orAny(trigger.Webhook.Branch),
+			)
+		}
+		if trigger.Schedule != nil {
+			fmt.Printf("\tschedule %s %s %s\n",
+				trigger.Schedule.Cron,
+				orLocal(trigger.Schedule.Timezone),
+				orSkip(trigger.Schedule.Missed),
+			)
+		}
+		if trigger.After != nil {
+			fmt.Printf("\tafter %s %s\n", trigger.After.Job, orAny(trigger.After.Status))
+		}
+		if trigger.Watch != nil {
+			fmt.Printf("\twatch %s %s\n", trigger.Watch.Directory, orAny(trigger.Watch.Pattern))
+		}
+		for _, name := range sortedKeys(trigger.Parameters) {
+			fmt.Printf("\t\t%s=%s\n", name, trigger.Parameters[name])
+		}
+	}
+}
+
+/*
+List all schedule triggers with the times they were last run by the server and
+will run next
+*/
+func (a *Actions) ListSchedules() {
+	setup, err := loadSetup(a.path)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	schedules, err := loadSchedules(a.path, setup.Triggers, time.Now())
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if a.json {
+		printJSON(schedules)
+		return
+	}
+
+	fmt.Printf("%-32s\t%-16s\t%-20s\t%-8s\t%-25s\t%-25s\n", "Target", "Cron", "Timezone", "Missed", "Last", "Next")
+	for _, schedule := range schedules {
+		last := "Never"
+		if !schedule.Last.IsZero() {
+			last = schedule.Last.Format(time.RFC3339)
+		}
+		fmt.Printf("%-32s\t%-16s\t%-20s\t%-8s\t%-25s\t%-25s\n",
+			schedule.Trigger.Target(),
+			schedule.Trigger.Schedule.Cron,
+			orLocal(schedule.Trigger.Schedule.Timezone),
+			orSkip(schedule.Trigger.Schedule.Missed),
+			last,
+			schedule.Next.Format(time.RFC3339),
+		)
 	}
 }
 
+/*
+Helper method for printing an empty timezone as the local timezone
+*/
+func orLocal(timezone string) string {
+	if timezone == "" {
+		return "Local"
+	}
+	return timezone
+}
+
+/*
+Helper method for printing an empty missed run policy as the default policy
+*/
+func orSkip(missed string) string {
+	if missed == "" {
+		return "skip"
+	}
+	return missed
+}
+
+/*
+Helper method for getting the keys of a map in sorted order
+*/
+func sortedKeys(values map[string]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Helper method for printing an empty trigger field as matching anything
+*/
+func orAny(value string) string {
+	if value == "" {
+		return "*"
+	}
+	return value
+}
+
 /*
 List all scripts
 */
@@ -74,6 +266,12 @@ func (a *Actions) ListScripts() {
 	setup, err := loadSetup(a.path)
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if a.json {
+		printJSON(setup.Scripts)
+		return
 	}
 
 	for _, script := range setup.Scripts {
@@ -88,33 +286,463 @@ func (a *Actions) ListLogs() {
 	logs, err := loadLogs(a.path)
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if a.json {
+		printJSON(logs)
+		return
 	}
 
-	fmt.Printf("%-20s\t%-20s\t%-20s\t%-32s\t%-32s\n", "Id", "Job", "Status", "Start", "End")
+	fmt.Printf("%-20s\t%-20s\t%-20s\t%-32s\t%-32s\t%s\n", "Id", "Job", "Status", "Start", "End", "Failed steps")
 	for _, log := range logs {
-		fmt.Printf("%-20s\t%-20s\t%-20s\t%-32s\t%-32s\n", log.Id, log.JobId, log.Status, log.StartTime, log.EndTime)
+		fmt.Printf("%-20s\t%-20s\t%-20s\t%-32s\t%-32s\t%s\n", log.Id, log.JobId, log.Status, log.StartTime, log.EndTime, strings.Join(log.FailedSteps(), ", "))
 	}
 }
 
 /*
-Run the job with the given id
+List the queued jobs in the order they were queued, along with the limits on
+the number of concurrent jobs they are subject to
 */
-func (a *Actions) RunJob(jobId string) {
-	log := newLog(jobId)
+func (a *Actions) ListQueue() {
+	setup, err := loadSetup(a.path)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
 
-	pipeline, err := buildPipeline(a.path, jobId, log)
+	logs, err := loadLogs(a.path)
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	queued := queuedJobs(setup, logs)
+	if a.json {
+		printJSON(queued)
+		return
+	}
+
+	fmt.Printf("%-20s\t%-20s\t%s\n", "Log", "Job", "Limits")
+	for _, job := range queued {
+		limits := []string{}
+		for key, max := range job.Limits {
+			limits = append(limits, key+"="+strconv.Itoa(max))
+		}
+		sort.Strings(limits)
+		fmt.Printf("%-20s\t%-20s\t%s\n", job.LogId, job.JobId, strings.Join(limits, ", "))
+	}
+}
+
+/*
+Show the metadata of the log with the given id, including the status of each
+step of the job
+*/
+func (a *Actions) ShowLog(logId string) error {
+	log, err := findLog(a.path, logId)
+	if err != nil {
+		return err
+	}
+
+	if a.json {
+		printJSON(log)
+		return nil
+	}
+
+	fmt.Printf("Id:\t%s\n", log.Id)
+	fmt.Printf("Job:\t%s\n", log.JobId)
+	fmt.Printf("Status:\t%s\n", log.Status)
+	fmt.Printf("Start:\t%s\n", log.StartTime)
+	fmt.Printf("End:\t%s\n", log.EndTime)
+	if log.Event != nil {
+		fmt.Printf("Event:\t%s\n", log.Event)
+	}
+	for _, name := range sortedKeys(log.Parameters) {
+		fmt.Printf("Param:\t%s=%s\n", name, log.Parameters[name])
+	}
+	fmt.Println()
+
+	// Jobs with a matrix have the steps of each variant listed below the
+	// status of the variant
+	if len(log.Variants) == 0 {
+		printLogSteps(log)
+	}
+	for i, variant := range log.Variants {
+		if i > 0 {
+			fmt.Println()
+		}
+		duration := ""
+		if !variant.EndTime.IsZero() {
+			duration = variant.EndTime.Sub(variant.StartTime).String()
+		}
+		fmt.Printf("Variant:\t%s\t%s\t%s\n", variant.Id, variant.Status, duration)
+		printLogSteps(variant)
+	}
+
+	return nil
+}
+
+/*
+Print the status of the steps of a log, followed by the handlers, which are
+listed separately from the steps of the pipeline
+*/
+func printLogSteps(log Log) {
+	printSteps("Step", log.Steps)
+	if len(log.OnFailure) > 0 {
+		fmt.Println()
+		printSteps("OnFailure", log.OnFailure)
+	}
+	if len(log.Finally) > 0 {
+		fmt.Println()
+		printSteps("Finally", log.Finally)
+	}
+}
+
+/*
+Print the status of each of the steps in a table, with the given title in the
+heading of the column of step ids
+*/
+func printSteps(title string, steps []StepLog) {
+	fmt.Printf("%-20s\t%-20s\t%-32s\t%-10s\t%-4s\t%-8s\t%-16s\n", title, "Machine", "Script", "Status", "Exit", "Attempts", "Duration")
+	for _, step := range steps {
+		exitCode := ""
+		attempts := ""
+		duration := ""
+		if !step.EndTime.IsZero() {
+			exitCode = strconv.Itoa(step.ExitCode)
+			attempts = strconv.Itoa(step.Attempts)
+			duration = step.EndTime.Sub(step.StartTime).String()
+		}
+
+		script := strings.TrimSpace(step.Script + " " + strings.Join(step.Args, " "))
+		fmt.Printf("%-20s\t%-20s\t%-32s\t%-10s\t%-4s\t%-8s\t%-16s\n", step.Id, step.Machine, script, step.Status, exitCode, attempts, duration)
+
+		// Steps run on a group or tag have a row for each machine below
+		for _, machine := range step.Machines {
+			exitCode = ""
+			duration = ""
+			if !machine.EndTime.IsZero() {
+				exitCode = strconv.Itoa(machine.ExitCode)
+				duration = machine.EndTime.Sub(machine.StartTime).String()
+			}
+			fmt.Printf("%-20s\t%-20s\t%-32s\t%-10s\t%-4s\t%-8s\t%-16s\n", "", "  "+machine.Machine, "", machine.Status, exitCode, "", duration)
+		}
+	}
+}
+
+/*
+Print a value as indented JSON, used instead of the tabular output when the
+json flag is given
+*/
+func printJSON(value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+	fmt.Println(string(data))
+}
+
+/*
+Run the job with the given id, pruning logs according to the retention policy
+once it has finished. The job is cancelled if the process is interrupted or
+terminated. The parameters, and the event if the job was run because of one,
+are recorded in the log
+*/
+func (a *Actions) RunJob(jobId string, parameters map[string]string, event *Event) {
+	setup, err := loadSetup(a.path)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	job, err := findJob(setup, jobId)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	values, err := resolveParameters(job, parameters)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	err = a.runLog(newLog(jobId, values, event))
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+}
+
+/*
+Queue the job with the given id to be run by the server, printing the id of
+its log, or the queued job along with its limits when printing JSON. The
+parameters, and the event if the job was queued because of one, are recorded
+in the log
+*/
+func (a *Actions) QueueJob(jobId string, parameters map[string]string, event *Event) error {
+	setup, err := loadSetup(a.path)
+	if err != nil {
+		return err
+	}
+
+	job, err := findJob(setup, jobId)
+	if err != nil {
+		return err
+	}
+
+	values, err := resolveParameters(job, parameters)
+	if err != nil {
+		return err
+	}
+
+	// Create the output file, so the output can be followed while the job is
+	// waiting in the queue
+	log := newLog(jobId, values, event)
+	file, err := os.Create(a.path + "/logs/" + log.Id)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	log, err = queueLog(log, a.path)
+	if err != nil {
+		return err
+	}
+
+	if a.json {
+		printJSON(QueuedJob{LogId: log.Id, JobId: log.JobId, Limits: jobLimits(setup, job)})
+		return nil
+	}
+
+	fmt.Println(log.Id)
+	return nil
+}
+
+/*
+Start the queued job of the log with the given id, in the same way as running
+a job
+*/
+func (a *Actions) StartLog(logId string) error {
+	log, err := findLog(a.path, logId)
+	if err != nil {
+		return err
+	}
+
+	if log.Status != "Queued" {
+		return errors.New("Log '" + log.Id + "' is not queued")
+	}
+
+	return a.runLog(log)
+}
+
+/*
+Run the job of the log, printing the id of the log and tailing its output
+until the job has ended. If the job cannot be run, such as when it has been
+removed from the configuration, the log is ended with the status Error and the
+error is returned. A queued log cancelled before it was started is not run
+*/
+func (a *Actions) runLog(log Log) error {
+	// The first signal cancels the job, after which its handlers still
+	// run. A second signal cancels the handlers as well
+	ctx, cancel := context.WithCancel(context.Background())
+	abort, cancelHandlers := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+		<-signals
+		cancelHandlers()
+	}()
+
+	// The pid file is locked before the log is started, so a running log
+	// always has a process that can be signalled to cancel it
+	pidFile, err := writePidFile(a.path, log.Id)
+	if err != nil {
+		return errors.New("Failed to write pid file: " + err.Error())
 	}
+	defer removePidFile(a.path, log.Id, pidFile)
 
+	log, err = startLog(log, a.path)
+	if err != nil {
+		return err
+	}
+
+	pipeline, err := buildPipeline(a.path, log.JobId, log)
+	if err != nil {
+		failErr := failLog(log, a.path, err)
+		if failErr != nil {
+			fmt.Println("ERROR: Failed to save log: " + failErr.Error())
+		}
+		return err
+	}
+	pipeline.Abort = abort
+
+	done := make(chan struct{})
 	go func() {
-		pipeline.Run(a.path)
+		pipeline.Run(ctx, a.path)
+		close(done)
 	}()
 
 	fmt.Println(log.Id)
 
 	// Tail the log, ensuring the program does not terminate
 	a.GetLogOutput(log.Id)
+	<-done
+
+	_, err = pruneLogs(a.path, false)
+	if err != nil {
+		fmt.Println("ERROR: Failed to prune logs: " + err.Error())
+	}
+	return nil
+}
+
+/*
+Prune the logs that are not to be kept according to the retention policy. If
+dry run is set, the logs are only listed
+*/
+func (a *Actions) PruneLogs(dryRun bool) error {
+	pruned, err := pruneLogs(a.path, dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "Pruned"
+	if dryRun {
+		verb = "Would prune"
+	}
+	for _, log := range pruned {
+		fmt.Printf("%s %s (%s, %s)\n", verb, log.Id, log.JobId, log.StartTime)
+	}
+	return nil
+}
+
+/*
+Validate every configuration file of the setup, printing each problem found.
+An error is returned if any problems were found
+*/
+func (a *Actions) Validate() error {
+	v := validateAll(a.path)
+	if a.json {
+		printJSON(v.Problems)
+	} else {
+		for _, problem := range v.Problems {
+			fmt.Println(problem)
+		}
+	}
+
+	if len(v.Problems) == 1 {
+		return errors.New("1 problem found in the configuration")
+	}
+	if len(v.Problems) > 1 {
+		return errors.New(strconv.Itoa(len(v.Problems)) + " problems found in the configuration")
+	}
+	if !a.json {
+		fmt.Println("Configuration is valid")
+	}
+	return nil
+}
+
+/*
+Convert every configuration file of the setup to the given format, keeping the
+original files with the suffix .migrated. The configuration must be valid, so
+nothing is lost in the conversion
+*/
+func (a *Actions) ConvertConfig(format string) error {
+	if _, exists := convertExtensions[format]; !exists {
+		return errors.New("Unknown format '" + format + "', expected 'json', 'yaml' or 'toml'")
+	}
+
+	v := validateAll(a.path)
+	if len(v.Problems) > 0 {
+		for _, problem := range v.Problems {
+			fmt.Println(problem)
+		}
+		return errors.New("The configuration must be valid to be converted")
+	}
+
+	for _, file := range []string{machinesFile, groupsFile, jobsFile, actionsFile, triggersFile, serverFile, configFile} {
+		converted, err := convertConfig(a.path, file, format)
+		if err != nil {
+			return errors.New("Failed to convert " + configBase(file) + " configuration: " + err.Error())
+		}
+		if converted != "" {
+			fmt.Println("Converted " + configBase(file) + " configuration to " + converted)
+		}
+	}
+	return nil
+}
+
+/*
+List the names of all secrets
+*/
+func (a *Actions) ListSecrets() error {
+	secrets, err := openSecrets(a.path)
+	if err != nil {
+		return err
+	}
+
+	if a.json {
+		printJSON(secrets.Names())
+		return nil
+	}
+
+	for _, name := range secrets.Names() {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+/*
+Print the decrypted value of the secret with the given name
+*/
+func (a *Actions) GetSecret(name string) error {
+	secrets, err := openSecrets(a.path)
+	if err != nil {
+		return err
+	}
+
+	value, err := secrets.Get(name)
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
+
+/*
+Encrypt and store the value as the secret with the given name. A master key is
+generated if none exists yet
+*/
+func (a *Actions) SetSecret(name, value string) error {
+	secrets, err := openSecrets(a.path)
+	if err != nil {
+		return err
+	}
+
+	_, statErr := os.Stat(masterKeyPath(a.path))
+	created := os.IsNotExist(statErr) && os.Getenv(masterKeyVariable) == ""
+
+	err = secrets.Set(name, value)
+	if err != nil {
+		return err
+	}
+	if created {
+		fmt.Println("Created master key " + masterKeyPath(a.path) + ", keep a copy of it somewhere safe")
+	}
+	return nil
+}
+
+/*
+Remove the secret with the given name
+*/
+func (a *Actions) RemoveSecret(name string) error {
+	secrets, err := openSecrets(a.path)
+	if err != nil {
+		return err
+	}
+	return secrets.Remove(name)
 }
 
 /*
@@ -123,7 +751,7 @@ Execute the action with the given id
 func (a *Actions) ExecuteAction(actionId string) error {
 	setup, err := loadSetup(a.path)
 	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
+		return err
 	}
 
 	// Find the action
@@ -142,12 +770,16 @@ func (a *Actions) ExecuteAction(actionId string) error {
 		return errors.New("No action with the given id was found")
 	}
 
-	var cmd *exec.Cmd
+	if isFanOut(action.Machine) {
+		// If targeting a group or tag, execute on each of its machines
+		fanOut, err := buildActionFanOut(a.path, action, setup, newSyncWriter(os.Stdout))
+		if err != nil {
+			return err
+		}
+		return fanOut.Run(context.Background())
+	}
 
-	if action.Machine == "local" {
-		// If the script is to be executed locally, do so
-		cmd = exec.Command(action.Command)
-	} else {
+	if action.Machine != "local" {
 		// If not to be executed locally, find the machine
 		var machine Machine
 		found = false
@@ -165,17 +797,15 @@ func (a *Actions) ExecuteAction(actionId string) error {
 		}
 
 		// Do the execution
-		sshCommand := fmt.Sprintf(
-			"ssh -tt -o 'StrictHostKeyChecking no' -o 'BatchMode yes' %s@%s -p %s -i %s '%s'",
-			machine.User,
-			machine.Address,
-			machine.Port,
-			a.path+"/keys/"+machine.PrivateKey,
-			action.Command,
-		)
-		cmd = exec.Command("/bin/bash", "-c", sshCommand)
+		executor, err := newSSHExecutor(a.path, machine)
+		if err != nil {
+			return err
+		}
+		return executor.Interactive(action.Command)
 	}
 
+	// If the script is to be executed locally, do so
+	cmd := exec.Command(action.Command)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -190,27 +820,13 @@ func (a *Actions) GetLogOutput(logId string) {
 	// If the log id given is not full, search for the first log that
 	// matches the id prefix
 	if len(logId) < 16 {
-		match := ""
-		logs, err := loadLogs(a.path)
+		log, err := findLog(a.path, logId)
 		if err != nil {
 			fmt.Println("ERROR: " + err.Error())
-		}
-
-		for _, log := range logs {
-			if strings.HasPrefix(log.Id, logId) {
-				match = log.Id
-				break
-			}
-		}
-
-		// If no match, inform the user
-		if match == "" {
-			fmt.Println("ERROR: Log not found")
 			return
 		}
 
-		logId = match
-
+		logId = log.Id
 	}
 	t, err := tail.TailFile(a.path+"/logs/"+logId, tail.Config{Follow: true})
 	if err != nil {
@@ -219,13 +835,138 @@ func (a *Actions) GetLogOutput(logId string) {
 	}
 
 	for line := range t.Lines {
-		if line.Text == "-----Finished-----" || line.Text == "-----Error-----" {
+		if line.Text == "-----Finished-----" || line.Text == "-----Error-----" || line.Text == "-----TimedOut-----" || line.Text == "-----Cancelled-----" {
 			break
 		}
 		fmt.Println(line.Text)
 	}
 }
 
+/*
+Show the jobs that are running or queued, and the locks along with the jobs
+holding them
+*/
+func (a *Actions) Status() error {
+	setup, err := loadSetup(a.path)
+	if err != nil {
+		return err
+	}
+
+	logs, err := loadLogs(a.path)
+	if err != nil {
+		return err
+	}
+
+	locks, err := lockStatuses(a.path, setup.Jobs)
+	if err != nil {
+		return err
+	}
+
+	running := []Log{}
+	queued := []Log{}
+	for _, log := range logs {
+		if log.Status == "Running" {
+			running = append(running, log)
+		}
+		if log.Status == "Queued" {
+			queued = append(queued, log)
+		}
+	}
+
+	if a.json {
+		printJSON(struct {
+			Running []Log
+			Queued  []Log
+			Locks   []LockStatus
+		}{running, queued, locks})
+		return nil
+	}
+
+	fmt.Println("Running:")
+	for _, log := range running {
+		fmt.Printf("\t%-16s\t%-20s\tsince %s\n", log.Id, log.JobId, log.StartTime.Format(time.RFC3339))
+	}
+	fmt.Println("Queued:")
+	for _, log := range queued {
+		fmt.Printf("\t%-16s\t%-20s\tsince %s\n", log.Id, log.JobId, log.QueueTime.Format(time.RFC3339))
+	}
+	fmt.Println("Locks:")
+	for _, lock := range locks {
+		if !lock.Held {
+			fmt.Printf("\t%-20s\tfree\n", lock.Lock)
+		} else if lock.LogId == "" {
+			fmt.Printf("\t%-20s\theld\n", lock.Lock)
+		} else {
+			fmt.Printf("\t%-20s\theld by job %s (log %s, pid %d) since %s\n", lock.Lock, lock.JobId, lock.LogId, lock.Pid, lock.Since.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+/*
+Cancel the running job of the log with the given id, killing any commands in
+progress. The log is checked and cancelled while holding the lock of the log
+store, so a queued job cannot be started at the same time
+*/
+func (a *Actions) CancelLog(logId string) error {
+	log, err := findLog(a.path, logId)
+	if err != nil {
+		return err
+	}
+
+	signalled := false
+	log, err = openLogStore(a.path).Update(log.Id, func(log *Log) (bool, error) {
+		if log.Status != "Running" && log.Status != "Queued" {
+			return false, errors.New("Log '" + log.Id + "' is not running")
+		}
+
+		// Signal the process running the job, which cancels the job
+		// itself. Queued jobs are not run by any process yet
+		if log.Status == "Running" {
+			pid, err := readPidFile(a.path, log.Id)
+			if err == nil {
+				process, err := os.FindProcess(pid)
+				if err == nil && process.Signal(syscall.SIGTERM) == nil {
+					signalled = true
+					return false, nil
+				}
+			}
+
+			// The process running the job no longer exists, as it
+			// locks the pid file before starting the log, so any
+			// stale pid file is removed
+			os.Remove(pidFilePath(a.path, log.Id))
+		}
+
+		// The log is marked as cancelled directly
+		log.EndTime = time.Now()
+		log.Status = "Cancelled"
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if signalled {
+		fmt.Println("Cancelling " + log.Id)
+		return nil
+	}
+
+	file, err := os.OpenFile(a.path+"/logs/"+log.Id, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString("-----Cancelled-----\n")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Cancelled " + log.Id)
+	return nil
+}
+
 /*
 Interactive ssh
 */
@@ -250,22 +991,45 @@ func (a *Actions) SSH(machineId string) error {
 		return errors.New("No machine with the given id was found")
 	}
 
-	sshCommand := fmt.Sprintf(
-		"ssh -tt -o 'StrictHostKeyChecking no' -o 'BatchMode yes' %s@%s -p %s -i %s",
-		machine.User,
-		machine.Address,
-		machine.Port,
-		a.path+"/keys/"+machine.PrivateKey,
-	)
-	cmd := exec.Command("/bin/bash", "-c", sshCommand)
+	executor, err := newSSHExecutor(a.path, machine)
+	if err != nil {
+		return err
+	}
+	return executor.Interactive("")
+}
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+/*
+Record the host key of the machine with the given id in the known_hosts file
+*/
+func (a *Actions) Trust(machineId string) error {
+	setup, err := loadSetup(a.path)
+	if err != nil {
+		return err
+	}
 
-	return cmd.Run()
-}
+	var machine Machine
+	found := false
+	for _, m := range setup.Machines {
+		if m.Id == machineId {
+			machine = m
+			found = true
+			break
+		}
+	}
 
+	// Check if no machine matched
+	if !found {
+		return errors.New("No machine with the given id was found")
+	}
+
+	fingerprint, err := trustMachine(a.path, machine)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Trusted %s (%s)\n", machine.Id, fingerprint)
+	return nil
+}
 
 /*
 Copy files/directories from one machine to another
@@ -326,9 +1090,16 @@ func (a *Actions) SCP(from, to string) error {
 		toString = to
 	}
 
+	knownHosts, remove, err := toolKnownHosts(a.path, machine)
+	if err != nil {
+		return err
+	}
+	defer remove()
+
 	// Build and execute the command
 	scpCommand := fmt.Sprintf(
-		"scp -o 'StrictHostKeyChecking no' -o 'BatchMode yes' -i %s -P %s -r %s %s",
+		"scp -o 'StrictHostKeyChecking yes' -o 'UserKnownHostsFile %s' -o 'BatchMode yes' -i %s -P %s -r %s %s",
+		knownHosts,
 		a.path+"/keys/"+machine.PrivateKey,
 		machine.Port,
 		fromString,
@@ -367,14 +1138,21 @@ func (a *Actions) Mount(machineId string,remoteMountPoint string,localMountPoint
 		return errors.New("No machine with the given id was found")
 	}
 
+	knownHosts, remove, err := toolKnownHosts(a.path, machine)
+	if err != nil {
+		return err
+	}
+	defer remove()
+
         commandString := fmt.Sprintf(
-                "sshfs %s@%s:%s %s -p %s -o IdentityFile=%s -o sshfs_sync",
+                "sshfs %s@%s:%s %s -p %s -o IdentityFile=%s -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s -o sshfs_sync",
 		machine.User,
 		machine.Address,
                 remoteMountPoint,
                 localMountPoint,
 		machine.Port,
 		a.path+"/keys/"+machine.PrivateKey,
+		knownHosts,
 	)
 	cmd := exec.Command("/bin/bash", "-c", commandString)
 
@@ -0,0 +1,225 @@
+/*
+Definition of and methods for evaluating and validating the conditions of
+steps, given in the When field of a step. A step is skipped if its condition
+evaluates to false
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+The fields of the event that caused a job to run available in conditions, as
+event.<field>. The branch is also available as branch
+*/
+var eventFields = []string{"type", "repository", "ref", "branch", "commit", "schedule", "job", "log", "status", "path"}
+
+/*
+The fields of a step available in conditions, as steps.<id>.<field>
+*/
+var stepFields = []string{"status", "exit_code"}
+
+/*
+Type defining the condition of a step, along with the environment variables it
+can refer to
+*/
+type Condition struct {
+	Expression string
+	Env        map[string]string
+}
+
+/*
+Create the condition of a step, if it has one. The environment of the condition
+is the environment of Orchid along with the variables configured on the job and
+the step, without secrets being resolved
+*/
+func newCondition(job Job, executable Executable) *Condition {
+	if executable.When == "" {
+		return nil
+	}
+
+	env := map[string]string{}
+	for _, variable := range scriptEnviron() {
+		parts := strings.SplitN(variable, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	for name, value := range job.Env {
+		env[name] = value
+	}
+	for name, value := range executable.Env {
+		env[name] = value
+	}
+	return &Condition{Expression: executable.When, Env: env}
+}
+
+/*
+Evaluate the condition against the log of the job, which holds its parameters,
+the event that caused it to run, and the status of the steps
+*/
+func (c *Condition) evaluate(log Log) (bool, error) {
+	parsed, err := parseExpression(c.Expression)
+	if err != nil {
+		return false, err
+	}
+
+	value, err := parsed.eval(func(name string) (string, error) {
+		return c.lookup(name, log)
+	})
+	if err != nil {
+		return false, err
+	}
+	return toBool(value)
+}
+
+/*
+Look up the value of a name used in the condition
+*/
+func (c *Condition) lookup(name string, log Log) (string, error) {
+	event := Event{}
+	if log.Event != nil {
+		event = *log.Event
+	}
+
+	switch {
+	case name == "branch":
+		return event.Branch, nil
+	case strings.HasPrefix(name, "params."):
+		return log.Parameters[strings.TrimPrefix(name, "params.")], nil
+	case strings.HasPrefix(name, "env."):
+		return c.Env[strings.TrimPrefix(name, "env.")], nil
+	case strings.HasPrefix(name, "event."):
+		fields := map[string]string{
+			"type":       event.Type,
+			"repository": event.Repository,
+			"ref":        event.Ref,
+			"branch":     event.Branch,
+			"commit":     event.Commit,
+			"schedule":   event.Schedule,
+			"job":        event.JobId,
+			"log":        event.LogId,
+			"status":     event.Status,
+			"path":       event.Path,
+		}
+		if value, exists := fields[strings.TrimPrefix(name, "event.")]; exists {
+			return value, nil
+		}
+	case strings.HasPrefix(name, "steps."):
+		id, field := stepReference(name)
+		for _, step := range log.Steps {
+			if step.Id != id {
+				continue
+			}
+			if field == "status" {
+				return strings.ToLower(step.Status), nil
+			}
+			if field == "exit_code" {
+				return strconv.Itoa(step.ExitCode), nil
+			}
+		}
+	}
+	return "", errors.New("Unknown name '" + name + "'")
+}
+
+/*
+Get the id of the step and the field referred to by a name of the form
+steps.<id>.<field>
+*/
+func stepReference(name string) (string, string) {
+	name = strings.TrimPrefix(name, "steps.")
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
+}
+
+/*
+Validate the condition of the step at the given path, which is described by the
+given name for use in messages. The condition may only refer to the parameters
+of the job, including the axes of its matrix, and to the given steps, which
+have finished before the step runs
+*/
+func validateCondition(v *Validator, at string, job Job, executable Executable, step string, steps []string) {
+	if executable.When == "" {
+		return
+	}
+
+	at = fieldPath(at, "When")
+	parsed, err := parseExpression(executable.When)
+	if err != nil {
+		v.report(jobsFile, at, executable.When, step+" has an invalid When condition: "+err.Error())
+		return
+	}
+
+	parameters := []string{}
+	for _, parameter := range job.Parameters {
+		parameters = append(parameters, parameter.Name)
+	}
+	parameters = append(parameters, job.Matrix.axes()...)
+
+	for _, name := range parsed.names() {
+		switch {
+		case name == "branch":
+		case strings.HasPrefix(name, "params."):
+			parameter := strings.TrimPrefix(name, "params.")
+			if !contains(parameters, parameter) {
+				v.reportUnknown(jobsFile, at, parameter, step+" has a When condition referring to unknown parameter '"+parameter+"'", parameters)
+			}
+		case strings.HasPrefix(name, "env."):
+			if !variableName.MatchString(strings.TrimPrefix(name, "env.")) {
+				v.report(jobsFile, at, executable.When, step+" has a When condition referring to invalid environment variable name '"+strings.TrimPrefix(name, "env.")+"'")
+			}
+		case strings.HasPrefix(name, "event."):
+			field := strings.TrimPrefix(name, "event.")
+			if !contains(eventFields, field) {
+				v.reportUnknown(jobsFile, at, field, step+" has a When condition referring to unknown event field '"+field+"'", eventFields)
+			}
+		case strings.HasPrefix(name, "steps."):
+			id, field := stepReference(name)
+			if !contains(steps, id) {
+				v.reportUnknown(jobsFile, at, id, step+" has a When condition referring to step '"+id+"', which does not finish before it", steps)
+			} else if !contains(stepFields, field) {
+				v.reportUnknown(jobsFile, at, field, step+" has a When condition referring to unknown step field '"+field+"'", stepFields)
+			}
+		default:
+			v.report(jobsFile, at, executable.When, step+" has a When condition referring to unknown name '"+name+"', expected params.<name>, env.<name>, steps.<id>.<field>, event.<field> or branch")
+		}
+	}
+}
+
+/*
+Get the ids of the steps of the job that have finished before the step at the
+given index of the pipeline runs. These are the steps it needs, directly or
+indirectly, or the steps before it if the pipeline is a sequence
+*/
+func stepsBefore(job Job, index int) []string {
+	if !isDAG(job) {
+		ids := []string{}
+		for i := 0; i < index; i++ {
+			ids = append(ids, stepId(i, job.Pipeline[i]))
+		}
+		return ids
+	}
+
+	needs := map[string][]string{}
+	for i, executable := range job.Pipeline {
+		needs[stepId(i, executable)] = executable.Needs
+	}
+
+	ids := []string{}
+	pending := append([]string{}, job.Pipeline[index].Needs...)
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+		if contains(ids, id) {
+			continue
+		}
+		ids = append(ids, id)
+		pending = append(pending, needs[id]...)
+	}
+	return ids
+}
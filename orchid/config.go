@@ -0,0 +1,100 @@
+/*
+Definition of and methods for loading and validating the general configuration
+of the setup
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+Type defining the general configuration of the setup
+*/
+type Config struct {
+	Retention RetentionPolicy
+}
+
+/*
+Type defining which logs to keep. Zero values mean no limit
+*/
+type RetentionPolicy struct {
+	KeepRuns int
+	MaxAge   string
+	MaxSize  string
+}
+
+/*
+Load the general configuration. The configuration file is optional, and an empty
+configuration is returned if it does not exist
+*/
+func loadConfig(path string) (Config, error) {
+	v := newValidator(path)
+	config := Config{}
+	if v.load(configFile, &config, true) {
+		validateConfig(v, config)
+	}
+
+	err := v.err()
+	if err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+/*
+Validate the general configuration
+*/
+func validateConfig(v *Validator, config Config) {
+	if config.Retention.KeepRuns < 0 {
+		v.report(configFile, "Retention.KeepRuns", strconv.Itoa(config.Retention.KeepRuns), "Retention must not have a negative KeepRuns")
+	}
+	if _, err := parseDuration(config.Retention.MaxAge); err != nil {
+		v.report(configFile, "Retention.MaxAge", config.Retention.MaxAge, "Retention must have a MaxAge that is a positive duration such as '720h', got '"+config.Retention.MaxAge+"'")
+	}
+	if _, err := parseSize(config.Retention.MaxSize); err != nil {
+		v.report(configFile, "Retention.MaxSize", config.Retention.MaxSize, "Retention must have a MaxSize that is a size such as '500MB', got '"+config.Retention.MaxSize+"'")
+	}
+}
+
+/*
+Parse a size in bytes given with an optional unit of KB, MB or GB. An empty size
+is returned as zero
+*/
+func parseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	value = strings.ToUpper(strings.TrimSpace(value))
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, errors.New("Size must be positive")
+	}
+	return size * factor, nil
+}
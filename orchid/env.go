@@ -0,0 +1,102 @@
+/*
+Methods for building the environment variables passed to the steps of a job
+*/
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Pattern matching a valid name of an environment variable, which parameters
+names must match as well
+*/
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/*
+Prefix of the names of the built-in environment variables, which cannot be
+configured
+*/
+const builtinPrefix = "ORCHID_"
+
+/*
+Validate the names of the environment variables configured at the given path
+of a file, and of the secrets they refer to. The owner describes where the
+variables are configured, for use in messages
+*/
+func validateEnv(v *Validator, file, path string, env map[string]string, owner string) {
+	for _, name := range sortedKeys(env) {
+		if !variableName.MatchString(name) {
+			v.report(file, fieldPath(path, name), name, owner+" contains invalid environment variable name '"+name+"'")
+		} else if strings.HasPrefix(name, builtinPrefix) {
+			v.report(file, fieldPath(path, name), name, owner+" contains environment variable '"+name+"', but names starting with "+builtinPrefix+" are reserved")
+		}
+		if secret, isSecret := secretReference(env[name]); isSecret && !secretName.MatchString(secret) {
+			v.report(file, fieldPath(path, name), env[name], owner+" contains environment variable '"+name+"' referring to invalid secret name '"+secret+"'")
+		}
+	}
+}
+
+/*
+Build the environment variables of a step in the form name=value, sorted by
+name. Variables are taken from the machine, the job, the step, the parameters
+of the job and the built-in variables, including the extra built-in variables
+given, in order of increasing precedence. Configured variables with values of
+the form secret:<name> are given the value of the secret, while parameters are
+never taken to refer to secrets
+*/
+func stepEnv(job Job, index int, executable Executable, machines []Machine, log Log, secrets *Secrets, extra map[string]string) ([]string, error) {
+	merged := map[string]string{}
+	merge := func(env map[string]string) {
+		for name, value := range env {
+			merged[name] = value
+		}
+	}
+	mergeConfigured := func(env map[string]string) error {
+		for name, value := range env {
+			if secret, isSecret := secretReference(value); isSecret {
+				var err error
+				value, err = secrets.Get(secret)
+				if err != nil {
+					return err
+				}
+			}
+			merged[name] = value
+		}
+		return nil
+	}
+
+	for _, machine := range machines {
+		if machine.Id == executable.Machine {
+			if err := mergeConfigured(machine.Env); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := mergeConfigured(job.Env); err != nil {
+		return nil, err
+	}
+	if err := mergeConfigured(executable.Env); err != nil {
+		return nil, err
+	}
+	merge(log.Parameters)
+	merge(map[string]string{
+		"ORCHID_LOG_ID":     log.Id,
+		"ORCHID_JOB_ID":     job.Id,
+		"ORCHID_STEP_ID":    stepId(index, executable),
+		"ORCHID_STEP_INDEX": strconv.Itoa(index),
+		"ORCHID_MACHINE":    executable.Machine,
+	})
+	merge(extra)
+
+	env := []string{}
+	for name, value := range merged {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
+}
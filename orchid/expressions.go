@@ -0,0 +1,474 @@
+/*
+Parser and evaluator of the expressions used in the conditions of steps, such
+as branch == "main" && steps.test.status == "ok". Expressions consist of
+string, number and boolean literals, names of values, the comparison operators
+==, !=, <, <=, > and >=, the logical operators &&, || and !, and parentheses
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+Type defining a token of an expression. The kind is one of "string", "number",
+"name", "operator" and "end"
+*/
+type token struct {
+	kind     string
+	text     string
+	position int
+}
+
+/*
+Type defining a parsed expression, which evaluates to a string, a number or a
+boolean, looking up the values of names with the given function
+*/
+type expression interface {
+	eval(lookup func(name string) (string, error)) (interface{}, error)
+	names() []string
+}
+
+/*
+Type defining a literal in an expression
+*/
+type literalExpression struct {
+	value interface{}
+}
+
+/*
+Type defining a name in an expression, which evaluates to the value of the name
+*/
+type nameExpression struct {
+	name string
+}
+
+/*
+Type defining the negation of an expression
+*/
+type notExpression struct {
+	operand expression
+}
+
+/*
+Type defining an operator applied to two expressions
+*/
+type binaryExpression struct {
+	operator string
+	left     expression
+	right    expression
+}
+
+/*
+Type defining the state of the parser of an expression
+*/
+type parser struct {
+	tokens []token
+	next   int
+}
+
+/*
+The operators of expressions, longest first so they are matched greedily
+*/
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+/*
+Split an expression into tokens
+*/
+func tokenize(source string) ([]token, error) {
+	tokens := []token{}
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			// Strings are quoted with either kind of quote, and may contain
+			// the quote escaped by a backslash
+			start := i
+			text := ""
+			i++
+			for i < len(source) && source[i] != c {
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+				}
+				text += string(source[i])
+				i++
+			}
+			if i == len(source) {
+				return nil, errors.New("Unterminated string at position " + strconv.Itoa(start+1))
+			}
+			i++
+			tokens = append(tokens, token{kind: "string", text: text, position: start})
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(source) && source[i+1] >= '0' && source[i+1] <= '9':
+			start := i
+			i++
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: "number", text: source[start:i], position: start})
+		case isNameStart(c):
+			// Names consist of parts separated by dots, and may contain
+			// dashes as step ids often do
+			start := i
+			for i < len(source) && (isNameStart(source[i]) || source[i] >= '0' && source[i] <= '9' || source[i] == '.' || source[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{kind: "name", text: source[start:i], position: start})
+		default:
+			matched := false
+			for _, operator := range operators {
+				if strings.HasPrefix(source[i:], operator) {
+					tokens = append(tokens, token{kind: "operator", text: operator, position: i})
+					i += len(operator)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, errors.New("Unexpected character '" + string(c) + "' at position " + strconv.Itoa(i+1))
+			}
+		}
+	}
+	return append(tokens, token{kind: "end", position: len(source)}), nil
+}
+
+/*
+Check whether a character may start a name
+*/
+func isNameStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+/*
+Parse an expression
+*/
+func parseExpression(source string) (expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	parsed, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != "end" {
+		return nil, p.unexpected()
+	}
+	return parsed, nil
+}
+
+/*
+Get the next token without consuming it
+*/
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+/*
+Check whether the next token is the given operator, consuming it if it is
+*/
+func (p *parser) accept(operator string) bool {
+	if p.peek().kind == "operator" && p.peek().text == operator {
+		p.next++
+		return true
+	}
+	return false
+}
+
+/*
+Get the error for an unexpected next token
+*/
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == "end" {
+		return errors.New("Unexpected end of expression")
+	}
+	return errors.New("Unexpected '" + t.text + "' at position " + strconv.Itoa(t.position+1))
+}
+
+/*
+Parse expressions joined by ||, which binds loosest
+*/
+func (p *parser) parseOr() (expression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression{operator: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+/*
+Parse expressions joined by &&
+*/
+func (p *parser) parseAnd() (expression, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression{operator: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+/*
+Parse an expression that may be negated
+*/
+func (p *parser) parseNot() (expression, error) {
+	if p.accept("!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpression{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+/*
+Parse a comparison, or a single operand if no comparison operator follows it
+*/
+func (p *parser) parseComparison() (expression, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(operator) {
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return binaryExpression{operator: operator, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+/*
+Parse a literal, a name, or an expression in parentheses
+*/
+func (p *parser) parseOperand() (expression, error) {
+	t := p.peek()
+	switch {
+	case t.kind == "string":
+		p.next++
+		return literalExpression{value: t.text}, nil
+	case t.kind == "number":
+		p.next++
+		number, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, errors.New("Invalid number '" + t.text + "' at position " + strconv.Itoa(t.position+1))
+		}
+		return literalExpression{value: number}, nil
+	case t.kind == "name" && (t.text == "true" || t.text == "false"):
+		p.next++
+		return literalExpression{value: t.text == "true"}, nil
+	case t.kind == "name":
+		p.next++
+		return nameExpression{name: t.text}, nil
+	case p.accept("("):
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.unexpected()
+		}
+		return inner, nil
+	}
+	return nil, p.unexpected()
+}
+
+/*
+Evaluate the literal
+*/
+func (e literalExpression) eval(lookup func(name string) (string, error)) (interface{}, error) {
+	return e.value, nil
+}
+
+/*
+Get the names used by the literal, which are none
+*/
+func (e literalExpression) names() []string {
+	return nil
+}
+
+/*
+Evaluate the name, which is always a string
+*/
+func (e nameExpression) eval(lookup func(name string) (string, error)) (interface{}, error) {
+	return lookup(e.name)
+}
+
+/*
+Get the names used by the name, which is the name itself
+*/
+func (e nameExpression) names() []string {
+	return []string{e.name}
+}
+
+/*
+Evaluate the negation of the operand
+*/
+func (e notExpression) eval(lookup func(name string) (string, error)) (interface{}, error) {
+	value, err := e.operand.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	truth, err := toBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return !truth, nil
+}
+
+/*
+Get the names used by the operand
+*/
+func (e notExpression) names() []string {
+	return e.operand.names()
+}
+
+/*
+Evaluate the operator applied to the operands. The right operand of && and ||
+is only evaluated if needed
+*/
+func (e binaryExpression) eval(lookup func(name string) (string, error)) (interface{}, error) {
+	left, err := e.left.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.operator == "&&" || e.operator == "||" {
+		truth, err := toBool(left)
+		if err != nil {
+			return nil, err
+		}
+		if truth == (e.operator == "||") {
+			return truth, nil
+		}
+		right, err := e.right.eval(lookup)
+		if err != nil {
+			return nil, err
+		}
+		return toBool(right)
+	}
+
+	right, err := e.right.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	// Values are compared as numbers if either of them is a number, and
+	// otherwise as text. Only numbers can be ordered
+	leftNumber, leftErr := toNumber(left)
+	rightNumber, rightErr := toNumber(right)
+	_, leftIsNumber := left.(float64)
+	_, rightIsNumber := right.(float64)
+	numeric := (leftIsNumber || rightIsNumber) && leftErr == nil && rightErr == nil
+
+	switch e.operator {
+	case "==":
+		if numeric {
+			return leftNumber == rightNumber, nil
+		}
+		return toText(left) == toText(right), nil
+	case "!=":
+		if numeric {
+			return leftNumber != rightNumber, nil
+		}
+		return toText(left) != toText(right), nil
+	}
+
+	if leftErr != nil {
+		return nil, leftErr
+	}
+	if rightErr != nil {
+		return nil, rightErr
+	}
+	switch e.operator {
+	case "<":
+		return leftNumber < rightNumber, nil
+	case "<=":
+		return leftNumber <= rightNumber, nil
+	case ">":
+		return leftNumber > rightNumber, nil
+	}
+	return leftNumber >= rightNumber, nil
+}
+
+/*
+Get the names used by the operands
+*/
+func (e binaryExpression) names() []string {
+	return append(e.left.names(), e.right.names()...)
+}
+
+/*
+Convert a value to a boolean. The strings "true" and "false" are taken as
+booleans, and the empty string as false
+*/
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if v == "true" {
+			return true, nil
+		}
+		if v == "false" || v == "" {
+			return false, nil
+		}
+	}
+	return false, errors.New("Expected a boolean, got '" + toText(value) + "'")
+}
+
+/*
+Convert a value to a number. Strings holding numbers are taken as numbers
+*/
+func toNumber(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			return number, nil
+		}
+	}
+	return 0, errors.New("Expected a number, got '" + toText(value) + "'")
+}
+
+/*
+Convert a value to text
+*/
+func toText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
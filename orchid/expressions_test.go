@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+/*
+The log the conditions in the tests are evaluated against
+*/
+var conditionLog = Log{
+	Parameters: map[string]string{"count": "3", "deploy": "true", "environment": "prod"},
+	Event:      &Event{Type: "push", Branch: "main"},
+	Steps: []StepLog{
+		{Id: "test", Status: "Ok"},
+		{Id: "build-1", Status: "Failed", ExitCode: 2},
+	},
+}
+
+func TestParseExpression(t *testing.T) {
+	valid := []string{
+		`branch == "main"`,
+		`params.deploy`,
+		`!(a || b) && c != 'x'`,
+		`steps.build-1.exit_code >= 2`,
+	}
+	for _, source := range valid {
+		if _, err := parseExpression(source); err != nil {
+			t.Errorf("Expected %s to parse, got %v", source, err)
+		}
+	}
+
+	invalid := []string{
+		``,
+		`branch ==`,
+		`"unterminated`,
+		`a @ b`,
+		`(a`,
+		`a)`,
+		`branch == "x" branch`,
+		`a = b`,
+	}
+	for _, source := range invalid {
+		if _, err := parseExpression(source); err == nil {
+			t.Errorf("Expected %s to fail to parse", source)
+		}
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	cases := map[string]bool{
+		`branch == "main" && steps.test.status == "ok"`:                     true,
+		`branch == 'dev' || steps.build-1.exit_code == 2`:                   true,
+		`params.count > 2 && params.count <= 3`:                             true,
+		`params.count == 3.0`:                                               true,
+		`params.count == "3.0"`:                                             false,
+		`params.deploy`:                                                     true,
+		`!params.deploy || event.type != "push"`:                            false,
+		`(params.environment == "prod") && !(steps.build-1.status == "ok")`: true,
+		`env.REGION == "eu"`:                                                true,
+		`event.schedule == ""`:                                              true,
+		`steps.build-1.status == "failed" || params.missing == "x"`:         true,
+	}
+	for source, expected := range cases {
+		condition := &Condition{Expression: source, Env: map[string]string{"REGION": "eu"}}
+		actual, err := condition.evaluate(conditionLog)
+		if err != nil {
+			t.Errorf("Expected %s to evaluate, got %v", source, err)
+		} else if actual != expected {
+			t.Errorf("Expected %s to be %t, got %t", source, expected, actual)
+		}
+	}
+}
+
+func TestEvaluateConditionErrors(t *testing.T) {
+	invalid := []string{
+		`params.environment > 1`,
+		`params.environment`,
+		`"text"`,
+		`steps.unknown.status == "ok"`,
+		`unknown == "x"`,
+	}
+	for _, source := range invalid {
+		condition := &Condition{Expression: source}
+		if _, err := condition.evaluate(conditionLog); err == nil {
+			t.Errorf("Expected %s to fail to evaluate", source)
+		}
+	}
+}
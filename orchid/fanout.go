@@ -0,0 +1,299 @@
+/*
+Execution of a step or action on every machine of a group or tag, running it on
+several machines in parallel and rolling it out in batches
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Type defining a command run on every machine of a group or tag, rolled out in
+batches according to the strategy. At most MaxParallel machines of a batch run
+the command at the same time, or every machine of the batch at once if it is
+zero. The results of the machines are available once the command has finished,
+and the machines touched are recorded across every run of the command
+*/
+type FanOut struct {
+	Commands    []MachineCommand
+	MaxParallel int
+	Strategy    *Strategy
+	Out         io.Writer
+	Results     []MachineLog
+	Touched     []string
+	mutex       sync.Mutex
+}
+
+/*
+Type defining the command run on a single machine of a fan out, along with the
+health check run after it, if any, and the writer prefixing their output with
+the machine id
+*/
+type MachineCommand struct {
+	Machine string
+	Cmd     Command
+	Check   Command
+	Prefix  *PrefixWriter
+}
+
+/*
+Run the command on every machine, one batch after the other, waiting for all
+machines of a batch to finish before starting the next. Once more machines
+than allowed by the strategy have failed no further machines are started, and
+machines not yet started when the context is done are not started either. If
+the command failed on any machine, the machines it failed on are written to the
+output, and the error of the first of them is returned if the failures are not
+tolerated
+*/
+func (f *FanOut) Run(ctx context.Context) error {
+	f.Results = make([]MachineLog, len(f.Commands))
+	for i, command := range f.Commands {
+		f.Results[i] = MachineLog{Machine: command.Machine, Status: "Pending"}
+	}
+	errs := make([]error, len(f.Commands))
+	maxFailures := f.Strategy.maxFailures()
+
+	batches := f.Strategy.batches(len(f.Commands))
+	start := 0
+	for b, size := range batches {
+		if b > 0 && f.Strategy.pause() > 0 {
+			fmt.Fprintf(f.Out, "Waiting %s before the next batch\n", f.Strategy.pause())
+			select {
+			case <-time.After(f.Strategy.pause()):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		if len(batches) > 1 {
+			ids := []string{}
+			for _, command := range f.Commands[start : start+size] {
+				ids = append(ids, command.Machine)
+			}
+			fmt.Fprintf(f.Out, "-----Batch %d of %d: %s-----\n", b+1, len(batches), strings.Join(ids, ", "))
+		}
+		f.runBatch(ctx, start, start+size, errs, maxFailures)
+		start += size
+
+		if failures(errs) > maxFailures {
+			break
+		}
+	}
+
+	// Machines never started are skipped if the rollout was aborted
+	skipped := []string{}
+	for i, result := range f.Results {
+		if !result.StartTime.IsZero() {
+			continue
+		}
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err()
+			f.Results[i].Status = contextStatus(ctx)
+		} else {
+			f.Results[i].Status = "Skipped"
+			skipped = append(skipped, result.Machine)
+		}
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(f.Out, "Aborted rollout after %d failed machines, skipping: %s\n", failures(errs), strings.Join(skipped, ", "))
+	}
+
+	failed := []string{}
+	var first error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, f.Commands[i].Machine)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		fmt.Fprintf(f.Out, "Failed on %d of %d machines: %s\n", len(failed), len(f.Commands), strings.Join(failed, ", "))
+	}
+	if len(failed) > maxFailures || ctx.Err() != nil {
+		return first
+	}
+	return nil
+}
+
+/*
+Run the command on the machines of a batch, given by the range of indices of
+the commands, recording the error of each machine. Machines are not started
+once more machines than allowed have failed, or once the context is done
+*/
+func (f *FanOut) runBatch(ctx context.Context, from, to int, errs []error, maxFailures int) {
+	parallel := f.MaxParallel
+	if parallel <= 0 || parallel > to-from {
+		parallel = to - from
+	}
+	slots := make(chan struct{}, parallel)
+
+	var wait sync.WaitGroup
+	for i := from; i < to; i++ {
+		// Wait for a machine to finish if the maximum number of machines
+		// are running
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		f.mutex.Lock()
+		aborted := ctx.Err() != nil || failures(errs) > maxFailures
+		if !aborted {
+			f.Results[i].StartTime = time.Now()
+			if !contains(f.Touched, f.Commands[i].Machine) {
+				f.Touched = append(f.Touched, f.Commands[i].Machine)
+			}
+		}
+		f.mutex.Unlock()
+		if aborted {
+			break
+		}
+
+		wait.Add(1)
+		go func(i int, command MachineCommand) {
+			defer wait.Done()
+			defer func() { <-slots }()
+
+			err := command.Cmd.Run(ctx)
+			if err == nil && command.Check != nil {
+				if command.Prefix != nil {
+					fmt.Fprintln(command.Prefix, "-----Health check-----")
+				}
+				err = command.Check.Run(ctx)
+			}
+			if command.Prefix != nil {
+				command.Prefix.Flush()
+			}
+
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			errs[i] = err
+			f.Results[i].EndTime = time.Now()
+			f.Results[i].ExitCode = exitStatus(err)
+			f.Results[i].Status = "Ok"
+			if err != nil {
+				f.Results[i].Status = contextStatus(ctx)
+			}
+		}(i, f.Commands[i])
+	}
+	wait.Wait()
+}
+
+/*
+Count the machines that have failed
+*/
+func failures(errs []error) int {
+	count := 0
+	for _, err := range errs {
+		if err != nil {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+Get the status of a command that returned an error while running with the given
+context
+*/
+func contextStatus(ctx context.Context) string {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return "TimedOut"
+	case context.Canceled:
+		return "Cancelled"
+	}
+	return "Failed"
+}
+
+/*
+Build the commands running a step on every machine of the group or tag it
+targets, passing the extra built-in environment variables to it. The output of
+each machine is prefixed with the machine id, after the given prefix, and
+written to the shared output
+*/
+func buildFanOut(path string, job Job, index int, executable Executable, setup Setup, log Log, secrets *Secrets, extra map[string]string, prefix string, out *SyncWriter) (*FanOut, error) {
+	ids := targetMachines(executable.Machine, setup.Machines, setup.Groups)
+	if len(ids) == 0 {
+		return nil, errors.New("No machines found for " + executable.Machine)
+	}
+
+	fanOut := &FanOut{MaxParallel: executable.MaxParallel, Strategy: executable.Strategy}
+	for _, id := range ids {
+		// Each machine is given its own environment, as the environment
+		// variables of the machine are included
+		machineExecutable := executable
+		machineExecutable.Machine = id
+		env, err := stepEnv(job, index, machineExecutable, setup.Machines, log, secrets, extra)
+		if err != nil {
+			return nil, err
+		}
+
+		writer := newPrefixWriter(prefix+"["+id+"] ", out)
+		cmd, err := buildExecutable(path, machineExecutable, setup.Machines, env, writer)
+		if err != nil {
+			return nil, err
+		}
+		command := MachineCommand{Machine: id, Cmd: cmd, Prefix: writer}
+
+		// The health check is run like the step itself, without arguments
+		if executable.Strategy != nil && executable.Strategy.HealthCheck != "" {
+			check := machineExecutable
+			check.Script = executable.Strategy.HealthCheck
+			check.Args = nil
+			command.Check, err = buildExecutable(path, check, setup.Machines, env, writer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fanOut.Commands = append(fanOut.Commands, command)
+	}
+	return fanOut, nil
+}
+
+/*
+Build the commands running an action on every machine of the group or tag it
+targets, writing the output of each machine prefixed with the machine id
+*/
+func buildActionFanOut(path string, action Action, setup Setup, out *SyncWriter) (*FanOut, error) {
+	ids := targetMachines(action.Machine, setup.Machines, setup.Groups)
+	if len(ids) == 0 {
+		return nil, errors.New("No machines found for " + action.Machine)
+	}
+
+	fanOut := &FanOut{MaxParallel: action.MaxParallel, Out: out}
+	for _, id := range ids {
+		var machine Machine
+		for _, m := range setup.Machines {
+			if m.Id == id {
+				machine = m
+			}
+		}
+
+		executor, err := newSSHExecutor(path, machine)
+		if err != nil {
+			return nil, err
+		}
+
+		writer := newPrefixWriter("["+id+"] ", out)
+		cmd := RemoteCommand{
+			Executor: executor,
+			Command:  action.Command,
+			Stdout:   writer,
+			Stderr:   writer,
+		}
+		fanOut.Commands = append(fanOut.Commands, MachineCommand{Machine: id, Cmd: cmd, Prefix: writer})
+	}
+	return fanOut, nil
+}
@@ -0,0 +1,477 @@
+/*
+Support for writing the configuration files in YAML or TOML instead of JSON.
+Files in other formats have the same schema as the JSON files, and are
+converted to JSON when loaded
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+The file extensions of the formats configuration files may be written in
+*/
+var configExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+/*
+The file extensions to convert configuration files to, by format
+*/
+var convertExtensions = map[string]string{
+	"json": ".json",
+	"yaml": ".yaml",
+	"toml": ".toml",
+}
+
+/*
+The configuration files holding a list rather than a single object. As a TOML
+document cannot be a list, the list is held in a table array named after the
+file, such as [[jobs]] in jobs.toml
+*/
+var listConfigs = []string{machinesFile, groupsFile, jobsFile, actionsFile, triggersFile, webhooksFile}
+
+/*
+The types the configuration files are decoded into
+*/
+var configTypes = map[string]reflect.Type{
+	machinesFile: reflect.TypeOf([]Machine{}),
+	groupsFile:   reflect.TypeOf([]Group{}),
+	jobsFile:     reflect.TypeOf([]Job{}),
+	actionsFile:  reflect.TypeOf([]Action{}),
+	triggersFile: reflect.TypeOf([]Trigger{}),
+	webhooksFile: reflect.TypeOf([]Webhook{}),
+	serverFile:   reflect.TypeOf(Server{}),
+	configFile:   reflect.TypeOf(Config{}),
+}
+
+/*
+Get the name of the configuration file without its extension, such as "jobs"
+*/
+func configBase(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file))
+}
+
+/*
+Get the files of the configuration with the given JSON file name that exist in
+the given directory, in any format
+*/
+func configVariants(path, file string) []string {
+	variants := []string{}
+	for _, extension := range configExtensions {
+		variant := configBase(file) + extension
+		if _, err := os.Stat(path + "/" + variant); err == nil {
+			variants = append(variants, variant)
+		}
+	}
+	return variants
+}
+
+/*
+Parse a YAML or TOML configuration file into a YAML node, which records the
+line of each value. The lines are only known for YAML files
+*/
+func parseConfig(file string, data []byte, logical string) (*yaml.Node, error) {
+	node := &yaml.Node{}
+	if filepath.Ext(file) != ".toml" {
+		err := yaml.Unmarshal(data, node)
+		return node, err
+	}
+
+	var document map[string]interface{}
+	_, err := toml.Decode(string(data), &document)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{} = document
+	if contains(listConfigs, logical) {
+		list, exists := document[configBase(logical)]
+		if !exists {
+			list = []interface{}{}
+		}
+		value = list
+	}
+
+	err = node.Encode(value)
+	return node, err
+}
+
+/*
+Get the value of a YAML node as decoded from JSON, after turning numbers and
+booleans into strings where the type the value is decoded into expects a string
+*/
+func nodeValue(node *yaml.Node, t reflect.Type) (interface{}, error) {
+	coerceNode(node, t)
+
+	var value interface{}
+	err := node.Decode(&value)
+	return value, err
+}
+
+/*
+Turn numbers and booleans in a YAML node into strings where the type the node
+is decoded into expects a string. This allows values such as ports to be
+written without quotes, as is common in YAML and TOML
+*/
+func coerceNode(node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			coerceNode(child, t)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			switch t.Kind() {
+			case reflect.Struct:
+				for j := 0; j < t.NumField(); j++ {
+					if strings.EqualFold(t.Field(j).Name, key) {
+						coerceNode(node.Content[i+1], t.Field(j).Type)
+					}
+				}
+			case reflect.Map:
+				coerceNode(node.Content[i+1], t.Elem())
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice {
+			for _, child := range node.Content {
+				coerceNode(child, t.Elem())
+			}
+		}
+	case yaml.ScalarNode:
+		if t.Kind() == reflect.String && (node.Tag == "!!int" || node.Tag == "!!float" || node.Tag == "!!bool") {
+			node.Tag = "!!str"
+		}
+	}
+}
+
+/*
+Map the path of every value in a YAML document, in lower case, to the line it
+is on
+*/
+func yamlLines(node *yaml.Node) map[string]int {
+	lines := map[string]int{}
+
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		if node.Line > 0 {
+			lines[strings.ToLower(path)] = node.Line
+		}
+
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, child := range node.Content {
+				walk(child, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				walk(node.Content[i+1], fieldPath(path, node.Content[i].Value))
+				if node.Content[i].Line > 0 {
+					lines[strings.ToLower(fieldPath(path, node.Content[i].Value))] = node.Content[i].Line
+				}
+			}
+		case yaml.SequenceNode:
+			for i, child := range node.Content {
+				walk(child, indexPath(path, i))
+			}
+		}
+	}
+
+	walk(node, "")
+	return lines
+}
+
+/*
+Convert the configuration file of a setup to the given format, which is one of
+"json", "yaml" and "toml". The converted file is written next to the original
+file, which is kept with the suffix .migrated. The name of the converted file
+is returned, or an empty name if the file is in the format already
+*/
+func convertConfig(path, file, format string) (string, error) {
+	extension, exists := convertExtensions[format]
+	if !exists {
+		return "", errors.New("Unknown format '" + format + "', expected 'json', 'yaml' or 'toml'")
+	}
+
+	variants := configVariants(path, file)
+	if len(variants) == 0 {
+		return "", nil
+	}
+	source := variants[0]
+	sourceExtension := filepath.Ext(source)
+	if sourceExtension == extension || (sourceExtension == ".yml" && extension == ".yaml") {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadFile(path + "/" + source)
+	if err != nil {
+		return "", err
+	}
+	var node *yaml.Node
+	if sourceExtension == ".json" {
+		node, err = jsonNode(data)
+	} else {
+		node, err = parseConfig(source, data, file)
+	}
+	if err != nil {
+		return "", err
+	}
+	coerceNode(node, configTypes[file])
+
+	var converted []byte
+	switch format {
+	case "json":
+		converted, err = nodeJSON(node)
+	case "yaml":
+		converted, err = nodeYAML(node)
+	case "toml":
+		converted, err = nodeTOML(node, file)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	target := configBase(file) + extension
+	err = ioutil.WriteFile(path+"/"+target, converted, 0644)
+	if err != nil {
+		return "", err
+	}
+	return target, os.Rename(path+"/"+source, path+"/"+source+".migrated")
+}
+
+/*
+Parse a JSON document into a YAML node, keeping the order of the fields. JSON
+is not parsed as YAML, as YAML does not allow indentation by tabs
+*/
+func jsonNode(data []byte) (*yaml.Node, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var parse func() (*yaml.Node, error)
+	parse = func() (*yaml.Node, error) {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case json.Delim:
+			node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			if token == '{' {
+				node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			for decoder.More() {
+				if node.Kind == yaml.MappingNode {
+					key, err := decoder.Token()
+					if err != nil {
+						return nil, err
+					}
+					node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+				}
+				child, err := parse()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, child)
+			}
+			_, err = decoder.Token()
+			return node, err
+		case string:
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: token}, nil
+		case json.Number:
+			if strings.ContainsAny(token.String(), ".eE") {
+				return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: token.String()}, nil
+			}
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: token.String()}, nil
+		case bool:
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(token)}, nil
+		default:
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+		}
+	}
+
+	node, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{node}}, nil
+}
+
+/*
+Write a YAML node as indented JSON, keeping the order of the fields
+*/
+func nodeJSON(node *yaml.Node) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	var write func(node *yaml.Node) error
+	write = func(node *yaml.Node) error {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			if len(node.Content) == 0 {
+				buffer.WriteString("null")
+				return nil
+			}
+			return write(node.Content[0])
+		case yaml.AliasNode:
+			return write(node.Alias)
+		case yaml.MappingNode:
+			buffer.WriteString("{")
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if i > 0 {
+					buffer.WriteString(",")
+				}
+				key, _ := json.Marshal(node.Content[i].Value)
+				buffer.Write(key)
+				buffer.WriteString(":")
+				if err := write(node.Content[i+1]); err != nil {
+					return err
+				}
+			}
+			buffer.WriteString("}")
+		case yaml.SequenceNode:
+			buffer.WriteString("[")
+			for i, child := range node.Content {
+				if i > 0 {
+					buffer.WriteString(",")
+				}
+				if err := write(child); err != nil {
+					return err
+				}
+			}
+			buffer.WriteString("]")
+		default:
+			var value interface{}
+			if err := node.Decode(&value); err != nil {
+				return err
+			}
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			buffer.Write(data)
+		}
+		return nil
+	}
+
+	err := write(node)
+	if err != nil {
+		return nil, err
+	}
+
+	var indented bytes.Buffer
+	err = json.Indent(&indented, buffer.Bytes(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	indented.WriteString("\n")
+	return indented.Bytes(), nil
+}
+
+/*
+Write a YAML node as YAML in block style, keeping the order of the fields. The
+styles of the nodes are reset, so nodes in flow style are written in block
+style
+*/
+func nodeYAML(node *yaml.Node) ([]byte, error) {
+	var reset func(node *yaml.Node)
+	reset = func(node *yaml.Node) {
+		node.Style = 0
+		for _, child := range node.Content {
+			reset(child)
+		}
+	}
+	reset(node)
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	err := encoder.Encode(node)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	return buffer.Bytes(), err
+}
+
+/*
+Write a YAML node as TOML. TOML has no null value, so null values are left
+out, and lists are held in a table array named after the file
+*/
+func nodeTOML(node *yaml.Node, file string) ([]byte, error) {
+	var value interface{}
+	err := node.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	value = withoutNulls(value)
+
+	if contains(listConfigs, file) {
+		if value == nil {
+			value = []interface{}{}
+		}
+		value = map[string]interface{}{configBase(file): value}
+	}
+
+	var buffer bytes.Buffer
+	err = toml.NewEncoder(&buffer).Encode(value)
+	return buffer.Bytes(), err
+}
+
+/*
+Remove the null values from the objects and lists of a decoded value
+*/
+func withoutNulls(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, element := range value {
+			if element == nil {
+				delete(value, key)
+				continue
+			}
+			value[key] = withoutNulls(element)
+		}
+	case []interface{}:
+		elements := []interface{}{}
+		for _, element := range value {
+			if element != nil {
+				elements = append(elements, withoutNulls(element))
+			}
+		}
+		return elements
+	}
+	return value
+}
+
+/*
+Get the line of a TOML parse error, or zero if it is not known
+*/
+func tomlErrorLine(err error) int {
+	if parseErr, ok := err.(toml.ParseError); ok {
+		return parseErr.Position.Line
+	}
+	return 0
+}
+
+/*
+Get a description of the files a configuration was found in, for use in
+messages
+*/
+func describeVariants(variants []string) string {
+	return "'" + strings.Join(variants, "', '") + "'"
+}
@@ -0,0 +1,22 @@
+module github.com/yaccio/orchid/orchid
+
+go 1.24
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/dchest/uniuri v1.2.0
+	github.com/hpcloud/tail v1.0.1-0.20170814160653-37f427138745
+	github.com/robfig/cron v1.2.0
+	golang.org/x/crypto v0.41.0
+	golang.org/x/term v0.34.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/sys v0.35.0 // indirect
+	gopkg.in/fsnotify.v1 v1.4.7 // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+)
+
+// gopkg.in/fsnotify.v1 is the old import path of github.com/fsnotify/fsnotify
+replace gopkg.in/fsnotify.v1 => github.com/fsnotify/fsnotify v1.4.9
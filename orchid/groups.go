@@ -0,0 +1,148 @@
+/*
+Definition of and methods for validating machine groups, and for resolving the
+machines targeted by steps and actions. A step or action targets a single
+machine by its id, the local machine as "local", every machine of a group as
+"group:<id>", or every machine with a tag as "tag:<tag>"
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+Prefixes of targets referring to several machines
+*/
+const (
+	groupPrefix = "group:"
+	tagPrefix   = "tag:"
+)
+
+/*
+Type defining a group of machines
+*/
+type Group struct {
+	Id       string
+	Machines []string
+}
+
+/*
+Check whether a target refers to a group or tag rather than a single machine
+*/
+func isFanOut(target string) bool {
+	return strings.HasPrefix(target, groupPrefix) || strings.HasPrefix(target, tagPrefix)
+}
+
+/*
+Get the ids of the machines a target refers to. The machines of a group are
+given in the order they are listed in the group, and the machines with a tag in
+the order they are configured
+*/
+func targetMachines(target string, machines []Machine, groups []Group) []string {
+	if strings.HasPrefix(target, groupPrefix) {
+		for _, group := range groups {
+			if group.Id == strings.TrimPrefix(target, groupPrefix) {
+				return group.Machines
+			}
+		}
+		return []string{}
+	}
+
+	if strings.HasPrefix(target, tagPrefix) {
+		ids := []string{}
+		for _, machine := range machines {
+			if contains(machine.Tags, strings.TrimPrefix(target, tagPrefix)) {
+				ids = append(ids, machine.Id)
+			}
+		}
+		return ids
+	}
+
+	return []string{target}
+}
+
+/*
+Get every tag of the given machines, in the order they are first used
+*/
+func machineTags(machines []Machine) []string {
+	tags := []string{}
+	for _, machine := range machines {
+		for _, tag := range machine.Tags {
+			if !contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+/*
+Validate the group configuration. Groups only contain configured machines, not
+the local machine
+*/
+func validateGroups(v *Validator, groups []Group, machines []Machine) {
+	ids := map[string]bool{}
+	configured := []string{}
+	for _, machine := range machines {
+		configured = append(configured, machine.Id)
+	}
+
+	for i, group := range groups {
+		at := indexPath("", i)
+		if group.Id == "" {
+			v.report(groupsFile, fieldPath(at, "Id"), "", "Each group must have a non-empty Id")
+		} else if ids[group.Id] {
+			v.report(groupsFile, fieldPath(at, "Id"), group.Id, "Group id '"+group.Id+"' is already in use")
+		}
+		ids[group.Id] = true
+
+		if len(group.Machines) == 0 {
+			v.report(groupsFile, fieldPath(at, "Machines"), "", "Group '"+group.Id+"' must have a non-empty list of Machines")
+		}
+		for j, machine := range group.Machines {
+			if v.loaded(machinesFile) && !contains(configured, machine) {
+				v.reportUnknown(groupsFile, indexPath(fieldPath(at, "Machines"), j), machine, "Group '"+group.Id+"' contains a reference to unknown machine '"+machine+"'", configured)
+			}
+		}
+	}
+}
+
+/*
+Validate the target of a step or action at the given path of a file, along
+with the maximum number of machines it runs on at the same time. The owner
+describes the step or action, for use in messages
+*/
+func validateTarget(v *Validator, file, path, target string, maxParallel int, owner string, machines []Machine, groups []Group) {
+	at := fieldPath(path, "Machine")
+	if target == "" {
+		v.report(file, at, "", owner+" must have a non-empty Machine")
+	} else if strings.HasPrefix(target, groupPrefix) {
+		groupIds := []string{}
+		for _, group := range groups {
+			groupIds = append(groupIds, group.Id)
+		}
+		id := strings.TrimPrefix(target, groupPrefix)
+		if v.loaded(groupsFile) && !contains(groupIds, id) {
+			v.report(file, at, target, owner+" contains a reference to unknown group '"+id+"'")
+			if suggestion := suggestion(id, groupIds); suggestion != "" {
+				v.Problems[len(v.Problems)-1].Suggestion = groupPrefix + suggestion
+			}
+		}
+	} else if strings.HasPrefix(target, tagPrefix) {
+		tag := strings.TrimPrefix(target, tagPrefix)
+		if v.loaded(machinesFile) && !contains(machineTags(machines), tag) {
+			v.report(file, at, target, owner+" targets tag '"+tag+"' which no machine has")
+			if suggestion := suggestion(tag, machineTags(machines)); suggestion != "" {
+				v.Problems[len(v.Problems)-1].Suggestion = tagPrefix + suggestion
+			}
+		}
+	} else if v.loaded(machinesFile) && !contains(machineIds(machines), target) {
+		v.reportUnknown(file, at, target, owner+" contains a reference to unknown machine '"+target+"'", machineIds(machines))
+	}
+
+	if maxParallel < 0 {
+		v.report(file, fieldPath(path, "MaxParallel"), strconv.Itoa(maxParallel), owner+" must not have a negative MaxParallel")
+	}
+}
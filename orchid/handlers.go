@@ -0,0 +1,159 @@
+/*
+Execution of the handlers of a job, which are the steps run once its pipeline
+has finished: the OnFailure steps if the pipeline failed, followed by the
+Finally steps regardless
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Run the handlers of the job once its pipeline has finished with the given
+error, if any. The handlers run even if the job timed out or was cancelled,
+limited only by their own timeouts and the abort context of the pipeline.
+Returns the error of the pipeline, or the error of the first failing Finally
+step if the pipeline succeeded
+*/
+func (p *Pipeline) runHandlers(path string, failure error) error {
+	job := p.builder.job
+	if len(job.OnFailure) == 0 && len(job.Finally) == 0 {
+		return failure
+	}
+
+	ctx := context.Background()
+	if p.Abort != nil {
+		ctx = p.Abort
+	}
+	extra := p.failureEnv(failure)
+
+	if failure != nil {
+		p.runHandler(ctx, path, "OnFailure", job.OnFailure, p.Log.OnFailure, extra)
+	} else {
+		for i := range p.Log.OnFailure {
+			p.Log.OnFailure[i].Status = "Skipped"
+		}
+		p.saveLog(path)
+	}
+
+	err := p.runHandler(ctx, path, "Finally", job.Finally, p.Log.Finally, extra)
+	if failure == nil {
+		return err
+	}
+	return failure
+}
+
+/*
+Run the steps of a handler one after the other, recording their results in the
+given logs. Every step is run even if an earlier step failed, and the error of
+the first failing step is returned. Once the context is done, the remaining
+steps are skipped
+*/
+func (p *Pipeline) runHandler(ctx context.Context, path, name string, executables []Executable, logs []StepLog, extra map[string]string) error {
+	if len(executables) == 0 {
+		return nil
+	}
+
+	// The output of the handler is separated from the output of the
+	// pipeline by a line naming the handler
+	fmt.Fprintf(p.Output, "-----%s-----\n", name)
+
+	var failure error
+	for i, executable := range executables {
+		stepLog := &logs[i]
+		if ctx.Err() != nil {
+			stepLog.Status = "Skipped"
+			p.saveLog(path)
+			if failure == nil {
+				failure = ctx.Err()
+			}
+			continue
+		}
+
+		step, built, err := p.builder.build(i, executable, "", extra)
+		if err != nil {
+			fmt.Fprintf(p.Output, "ERROR: Failed to run step %s of %s: %s\n", stepId(i, executable), name, err.Error())
+			stepLog.ExitCode = -1
+			stepLog.Status = "Failed"
+			p.saveLog(path)
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		p.builder.redact.setSecrets(p.builder.secrets.revealedValues())
+
+		run, err := p.checkCondition(path, stepLog, "step "+step.Id+" of "+name, step)
+		if err != nil && failure == nil {
+			failure = err
+		}
+		if !run {
+			continue
+		}
+
+		stepLog.Machines = built.Machines
+		stepLog.StartTime = time.Now()
+		stepLog.Status = "Running"
+		p.saveLog(path)
+
+		err = p.finishStep(path, stepLog, "Step "+step.Id+" of "+name, step.run(ctx))
+		if err != nil && failure == nil {
+			failure = err
+		}
+	}
+	return failure
+}
+
+/*
+Get the built-in environment variables passed to the handlers, describing the
+status of the job and the step that failed first, if any
+*/
+func (p *Pipeline) failureEnv(failure error) map[string]string {
+	status := "Ok"
+	switch failure {
+	case nil:
+	case context.DeadlineExceeded:
+		status = "TimedOut"
+	case context.Canceled:
+		status = "Cancelled"
+	default:
+		status = "Failed"
+	}
+	env := map[string]string{"ORCHID_JOB_STATUS": status}
+
+	var failed *StepLog
+	for i, step := range p.Log.Steps {
+		switch step.Status {
+		case "Failed", "TimedOut", "Cancelled":
+			if failed == nil || step.EndTime.Before(failed.EndTime) {
+				failed = &p.Log.Steps[i]
+			}
+		}
+	}
+	if failed != nil {
+		env["ORCHID_FAILED_STEP"] = failed.Id
+		env["ORCHID_FAILED_MACHINE"] = failed.Machine
+		env["ORCHID_FAILED_STATUS"] = failed.Status
+		env["ORCHID_FAILED_EXIT_CODE"] = strconv.Itoa(failed.ExitCode)
+		env["ORCHID_FAILED_TOUCHED"] = strings.Join(failed.Touched, ",")
+	}
+	return env
+}
+
+/*
+Create the logs of the steps of a handler, which have not yet been started
+*/
+func handlerLogs(executables []Executable, parameters map[string]string) []StepLog {
+	var logs []StepLog
+	for i, executable := range executables {
+		executable.Args = substituteParameters(executable.Args, parameters)
+		logs = append(logs, newStepLog(stepId(i, executable), executable))
+	}
+	return logs
+}
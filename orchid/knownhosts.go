@@ -0,0 +1,233 @@
+/*
+Host key verification for remote machines using a managed known_hosts file
+residing next to the machine configuration
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+/*
+Error returned by the host key callback used when trusting a machine, aborting
+the connection once the key has been captured
+*/
+var errHostKeyCaptured = errors.New("Host key captured")
+
+/*
+Get the path of the known_hosts file of the setup
+*/
+func knownHostsPath(path string) string {
+	return path + "/known_hosts"
+}
+
+/*
+Validate the format of a host key given in the machine configuration. The key
+is either a public key in authorized_keys format or a SHA256 fingerprint
+*/
+func validateHostKey(hostKey string) error {
+	if strings.HasPrefix(hostKey, "SHA256:") {
+		_, err := base64.RawStdEncoding.DecodeString(hostKey[len("SHA256:"):])
+		return err
+	}
+
+	_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	return err
+}
+
+/*
+Check whether a host key matches the host key given in the machine
+configuration
+*/
+func matchesHostKey(hostKey string, key ssh.PublicKey) bool {
+	if strings.HasPrefix(hostKey, "SHA256:") {
+		return ssh.FingerprintSHA256(key) == hostKey
+	}
+
+	expected, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(expected.Marshal(), key.Marshal())
+}
+
+/*
+Build the callback verifying the host key presented by a machine. The key must
+match the HostKey of the machine if one is configured, and must match the key
+recorded in the known_hosts file if one is recorded. If neither is present the
+machine has to be trusted explicitly before it can be used
+*/
+func hostKeyCallback(path string, machine Machine) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if machine.HostKey != "" && !matchesHostKey(machine.HostKey, key) {
+			return fmt.Errorf(
+				"Host key verification failed: Machine '%s' presented key %s which does not match its HostKey",
+				machine.Id,
+				ssh.FingerprintSHA256(key),
+			)
+		}
+
+		known, err := checkKnownHosts(path, hostname, remote, key)
+		if err != nil {
+			return fmt.Errorf("Host key verification failed: Machine '%s': %s", machine.Id, err.Error())
+		}
+
+		if !known && machine.HostKey == "" {
+			return fmt.Errorf(
+				"Host key verification failed: Machine '%s' is not trusted. Run 'orchid trust %s' to record its key %s",
+				machine.Id,
+				machine.Id,
+				ssh.FingerprintSHA256(key),
+			)
+		}
+
+		return nil
+	}
+}
+
+/*
+Check the key of a host against the known_hosts file. Returns whether the host
+is known, and an error if it is known with a different key
+*/
+func checkKnownHosts(path, hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	if _, err := os.Stat(knownHostsPath(path)); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	callback, err := knownhosts.New(knownHostsPath(path))
+	if err != nil {
+		return false, err
+	}
+
+	err = callback(hostname, remote, key)
+	if keyErr, ok := err.(*knownhosts.KeyError); ok {
+		if len(keyErr.Want) == 0 {
+			return false, nil
+		}
+		return false, errors.New("The host key has changed since it was trusted. It may have been replaced, or the connection may be intercepted")
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+/*
+Connect to a machine and record its host key in the known_hosts file. Fails if
+the key does not match the HostKey of the machine or a previously recorded key.
+Returns the fingerprint of the key
+*/
+func trustMachine(path string, machine Machine) (string, error) {
+	address := net.JoinHostPort(machine.Address, machine.Port)
+	hostKey, err := captureHostKey(machine)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint := ssh.FingerprintSHA256(hostKey)
+
+	if machine.HostKey != "" && !matchesHostKey(machine.HostKey, hostKey) {
+		return "", fmt.Errorf("Machine '%s' presented key %s which does not match its HostKey", machine.Id, fingerprint)
+	}
+
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return "", err
+	}
+
+	known, err := checkKnownHosts(path, address, remote, hostKey)
+	if err != nil {
+		return "", err
+	}
+	if known {
+		return fingerprint, nil
+	}
+
+	f, err := os.OpenFile(knownHostsPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey)
+	_, err = f.WriteString(line + "\n")
+	return fingerprint, err
+}
+
+/*
+Connect to a machine only to get the host key it presents, without verifying
+the key
+*/
+func captureHostKey(machine Machine) (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+	config := &ssh.ClientConfig{
+		User: machine.User,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyCaptured
+		},
+	}
+
+	_, err := ssh.Dial("tcp", net.JoinHostPort(machine.Address, machine.Port), config)
+	if hostKey == nil {
+		return nil, err
+	}
+	return hostKey, nil
+}
+
+/*
+Get a known_hosts file for tools such as scp and sshfs connecting to a machine,
+as these only verify host keys against a known_hosts file. For a machine with a
+HostKey, which may be a fingerprint only, the key the machine presents is
+verified the same way as for steps and written to a temporary known_hosts file.
+Other machines use the known_hosts file of the setup. The returned function
+removes any temporary file
+*/
+func toolKnownHosts(path string, machine Machine) (string, func(), error) {
+	if machine.HostKey == "" {
+		return knownHostsPath(path), func() {}, nil
+	}
+
+	address := net.JoinHostPort(machine.Address, machine.Port)
+	hostKey, err := captureHostKey(machine)
+	if err != nil {
+		return "", nil, err
+	}
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return "", nil, err
+	}
+	err = hostKeyCallback(path, machine)(address, remote, hostKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	file, err := ioutil.TempFile("", "orchid-known_hosts")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(file.Name()) }
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey)
+	_, err = file.WriteString(line + "\n")
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	return file.Name(), remove, nil
+}
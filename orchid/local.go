@@ -0,0 +1,51 @@
+/*
+Execution of scripts on the local machine
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+/*
+Type defining a script executed on the local machine
+*/
+type LocalScript struct {
+	Script string
+	Args   []string
+	Env    []string
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+/*
+Run the script with the environment variables added to the environment of
+Orchid, without the master key of the secrets, killing it along with every
+process it has started if the context is cancelled before the script has
+finished
+*/
+func (l LocalScript) Run(ctx context.Context) error {
+	scriptWithArgs := append([]string{l.Script}, l.Args...)
+	cmd := exec.CommandContext(ctx, "/bin/bash", scriptWithArgs...)
+	cmd.Env = append(scriptEnviron(), l.Env...)
+	cmd.Stdout = l.Stdout
+	cmd.Stderr = l.Stderr
+
+	// Run the script in its own process group, allowing the whole process
+	// tree to be killed at once
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	// Stop waiting for output if background processes keep the output open
+	// after the script has been killed
+	cmd.WaitDelay = 5 * time.Second
+
+	return cmd.Run()
+}
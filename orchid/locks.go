@@ -0,0 +1,210 @@
+/*
+Implementation of the named locks preventing jobs from running at the same
+time. Each lock is a file in the locks directory which is locked while a job
+holds the lock, and which records the job holding it
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+The interval at which a lock held by another job is tried again
+*/
+const lockRetryInterval = 500 * time.Millisecond
+
+/*
+Type defining a lock and the job holding it, if any
+*/
+type LockStatus struct {
+	Lock  string
+	Held  bool
+	JobId string `json:",omitempty"`
+	LogId string `json:",omitempty"`
+	Pid   int    `json:",omitempty"`
+	Since time.Time
+}
+
+/*
+Get the path of the file of the lock with the given name
+*/
+func lockFilePath(path, name string) string {
+	return path + "/locks/" + name + ".lock"
+}
+
+/*
+Check whether a lock name is valid, which is required as the name is used as a
+file name
+*/
+func validLockName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\") && !strings.HasPrefix(name, ".")
+}
+
+/*
+Acquire the locks with the given names for the job of the log, waiting while
+they are held by other jobs. The locks are acquired in sorted order, so jobs
+waiting for the same locks cannot deadlock. Waiting stops when the context is
+cancelled, or with an error once the timeout has passed if it is positive. The
+files of the locks acquired are returned, and must be released by the caller
+*/
+func acquireLocks(ctx context.Context, path string, names []string, log Log, timeout time.Duration, out io.Writer) ([]*os.File, error) {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err := os.MkdirAll(path+"/locks", 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*os.File{}
+	for _, name := range sorted {
+		file, err := os.OpenFile(lockFilePath(path, name), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			releaseLocks(files)
+			return nil, err
+		}
+
+		waiting := false
+		for {
+			err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				break
+			}
+			if err != syscall.EWOULDBLOCK {
+				file.Close()
+				releaseLocks(files)
+				return nil, err
+			}
+
+			if !waiting {
+				waiting = true
+				status, _ := lockStatus(path, name)
+				fmt.Fprintf(out, "Waiting for lock %s held by job %s (log %s)\n", name, status.JobId, status.LogId)
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				file.Close()
+				releaseLocks(files)
+				return nil, errors.New("Timed out waiting for lock " + name)
+			}
+
+			select {
+			case <-ctx.Done():
+				file.Close()
+				releaseLocks(files)
+				return nil, ctx.Err()
+			case <-time.After(lockRetryInterval):
+			}
+		}
+
+		// Record the job holding the lock for others to see
+		status := LockStatus{Lock: name, Held: true, JobId: log.JobId, LogId: log.Id, Pid: os.Getpid(), Since: time.Now()}
+		data, _ := json.Marshal(status)
+		file.Truncate(0)
+		file.WriteAt(data, 0)
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+/*
+Release the locks held through the given files
+*/
+func releaseLocks(files []*os.File) {
+	for _, file := range files {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+}
+
+/*
+Get the status of the lock with the given name, checking whether it is held by
+trying to acquire it
+*/
+func lockStatus(path, name string) (LockStatus, error) {
+	file, err := os.Open(lockFilePath(path, name))
+	if os.IsNotExist(err) {
+		return LockStatus{Lock: name}, nil
+	}
+	if err != nil {
+		return LockStatus{}, err
+	}
+	defer file.Close()
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return LockStatus{Lock: name}, nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		return LockStatus{}, err
+	}
+
+	// The holder may not have recorded itself yet, in which case only the
+	// fact that the lock is held is known
+	status := LockStatus{}
+	data, err := ioutil.ReadAll(file)
+	if err == nil {
+		json.Unmarshal(data, &status)
+	}
+	status.Lock = name
+	status.Held = true
+	return status, nil
+}
+
+/*
+Get the status of all locks, which are the locks of the given jobs and any
+other locks that have been held before
+*/
+func lockStatuses(path string, jobs []Job) ([]LockStatus, error) {
+	names := map[string]bool{}
+	for _, job := range jobs {
+		for _, name := range job.Locks {
+			names[name] = true
+		}
+	}
+
+	files, err := ioutil.ReadDir(path + "/locks")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".lock") {
+			names[strings.TrimSuffix(file.Name(), ".lock")] = true
+		}
+	}
+
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	statuses := []LockStatus{}
+	for _, name := range sorted {
+		status, err := lockStatus(path, name)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -5,136 +5,279 @@ Definition of and methods for logs including log persistence
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"github.com/dchest/uniuri"
+	"github.com/yaccio/orchid/orchid/shared"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 /*
-Definition of the log type
+The log type, which is shared with the server
 */
-type Log struct {
-	Id        string
-	JobId     string
-	Status    string
-	StartTime time.Time
-	EndTime   time.Time
-}
+type Log = shared.Log
 
 /*
-Save the log to the logs configuration file
+The event that caused the server to run a job
 */
-func (l Log) save(path string) error {
-	logs, err := loadLogs(path)
-	if err != nil {
-		return err
-	}
+type Event = shared.Event
 
-	found := false
-	for i, log := range logs {
-		if l.Id == log.Id {
-			found = true
-			logs[i] = l
-			break
-		}
-	}
+/*
+The log of a single step of a job
+*/
+type StepLog = shared.StepLog
 
-	if !found {
-		logs = append(logs, l)
-	}
+/*
+The result of a step on a single machine of a group or tag
+*/
+type MachineLog = shared.MachineLog
 
-	data, err := json.Marshal(logs)
-	if err != nil {
-		return err
-	}
+/*
+Save the log to the log store
+*/
+func saveLog(l Log, path string) error {
+	return openLogStore(path).Save(l)
+}
 
-	return ioutil.WriteFile(path+"/logs.json", data, 0644)
+/*
+Indicate that the job of the log has been queued by the server, setting the
+queue time and updating the persistent log configuration
+*/
+func queueLog(l Log, path string) (Log, error) {
+	l.QueueTime = time.Now()
+	l.Status = "Queued"
+	return l, saveLog(l, path)
 }
 
 /*
 Indicate that the log has started, setting the start time and updating the
-persistent log configuration
+persistent log configuration. A queued log is only started if it is still
+queued, as it may have been cancelled or started by another process meanwhile
 */
-func (l Log) start(path string) (Log, error) {
-	l.StartTime = time.Now()
-	l.Status = "Started"
-	return l, l.save(path)
+func startLog(l Log, path string) (Log, error) {
+	startTime := time.Now()
+	if l.Status != "Queued" {
+		l.StartTime = startTime
+		l.Status = "Running"
+		return l, saveLog(l, path)
+	}
+
+	return openLogStore(path).Update(l.Id, func(log *Log) (bool, error) {
+		if log.Status != "Queued" {
+			return false, errors.New("Log '" + log.Id + "' is no longer queued")
+		}
+		log.StartTime = startTime
+		log.Status = "Running"
+		return true, nil
+	})
 }
 
 /*
 Indicate that the log has finished, setting the end time and updating the
 persistent log configuration
 */
-func (l Log) finish(path string, file *os.File) (Log, error) {
+func finishLog(l Log, path string, file *os.File) (Log, error) {
 	l.EndTime = time.Now()
 	l.Status = "Finished"
-	return l, l.saveAndWriteToLog(path, file, "Finished")
+	return l, saveAndWriteToLog(l, path, file, "Finished")
 }
 
 /*
 Indicate that the log has encountered and error, setting the end time and
 updating the persistent log configuration
 */
-func (l Log) error(path string, file *os.File) (Log, error) {
+func errorLog(l Log, path string, file *os.File) (Log, error) {
 	l.EndTime = time.Now()
 	l.Status = "Error"
-	return l, l.saveAndWriteToLog(path, file, "Error")
+	return l, saveAndWriteToLog(l, path, file, "Error")
 }
 
 /*
-Helper method for saving the log and writing a terminating line to the log
+Indicate that the job of the log could not be run because of the given error,
+writing the error to the log output file before ending it with the status
+Error
+*/
+func failLog(l Log, path string, cause error) error {
+	file, err := os.OpenFile(path+"/logs/"+l.Id, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString("ERROR: " + cause.Error() + "\n")
+	if err != nil {
+		return err
+	}
+	_, err = errorLog(l, path, file)
+	return err
+}
+
+/*
+Indicate that the log has timed out, setting the end time and updating the
+persistent log configuration
+*/
+func timedOutLog(l Log, path string, file *os.File) (Log, error) {
+	l.EndTime = time.Now()
+	l.Status = "TimedOut"
+	return l, saveAndWriteToLog(l, path, file, "TimedOut")
+}
+
+/*
+Indicate that the log has been cancelled, setting the end time and updating the
+persistent log configuration
+*/
+func cancelLog(l Log, path string, file *os.File) (Log, error) {
+	l.EndTime = time.Now()
+	l.Status = "Cancelled"
+	return l, saveAndWriteToLog(l, path, file, "Cancelled")
+}
+
+/*
+Helper function for saving the log and writing a terminating line to the log
 output file
 */
-func (l Log) saveAndWriteToLog(path string, file *os.File, text string) error {
-	err := l.save(path)
+func saveAndWriteToLog(l Log, path string, file *os.File, text string) error {
+	err := saveLog(l, path)
 	if err != nil {
 		return err
 	}
 
-	_, err = file.WriteString("-----" + text + "-----")
+	_, err = file.WriteString("-----" + text + "-----\n")
 	return err
 }
 
 /*
-Create a new log, assigning it a new identifier
+Create a new log, assigning it a new identifier. The event is nil if the job
+was run manually
 */
-func newLog(jobId string) Log {
+func newLog(jobId string, parameters map[string]string, event *Event) Log {
 	return Log{
-		Id:     uniuri.New(),
-		JobId:  jobId,
-		Status: "New",
+		Id:         uniuri.New(),
+		JobId:      jobId,
+		Status:     "New",
+		Parameters: parameters,
+		Event:      event,
 	}
 }
 
 /*
-Load all logs stored locally
+Create a new log for a step of a job, which has not yet been started
 */
-func loadLogs(path string) ([]Log, error) {
-	// Create the file if it does not exist
-	f, err := os.OpenFile(path+"/logs.json", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
-	if err == nil {
-		// New file. Write empty list to it
-		_, err = f.WriteString("[]")
-		if err != nil {
-			f.Close()
-			return []Log{}, err
+func newStepLog(id string, executable Executable) StepLog {
+	return StepLog{
+		Id:      id,
+		Machine: executable.Machine,
+		Script:  executable.Script,
+		Args:    executable.Args,
+		Status:  "Pending",
+	}
+}
+
+/*
+Find the log with the given id. If the id given is not full, the first log
+matching the id prefix is returned
+*/
+func findLog(path, logId string) (Log, error) {
+	logs, err := loadLogs(path)
+	if err != nil {
+		return Log{}, err
+	}
+
+	for _, log := range logs {
+		if log.Id == logId {
+			return log, nil
 		}
 	}
-	f.Close()
 
-	// Load the file
-	logs := &[]Log{}
-	data, err := ioutil.ReadFile(path + "/logs.json")
+	if len(logId) < 16 {
+		for _, log := range logs {
+			if strings.HasPrefix(log.Id, logId) {
+				return log, nil
+			}
+		}
+	}
+
+	return Log{}, errors.New("Log not found")
+}
+
+/*
+Get the path of the file holding the id of the process running the job of the
+log with the given id
+*/
+func pidFilePath(path, logId string) string {
+	return path + "/logs/" + logId + ".pid"
+}
+
+/*
+Record that the job of the log with the given id is run by this process. The
+pid file is locked for as long as the returned file is open, which tells a pid
+file of a running job apart from one left behind by a process that has died
+*/
+func writePidFile(path, logId string) (*os.File, error) {
+	file, err := os.OpenFile(pidFilePath(path, logId), os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		return []Log{}, err
+		return nil, err
 	}
 
-	err = json.Unmarshal(data, &logs)
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		err = file.Truncate(0)
+	}
+	if err == nil {
+		_, err = file.WriteString(strconv.Itoa(os.Getpid()))
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+/*
+Remove the record of the process running the job of the log with the given id,
+releasing the lock on it
+*/
+func removePidFile(path, logId string, file *os.File) error {
+	err := os.Remove(pidFilePath(path, logId))
+	file.Close()
+	return err
+}
+
+/*
+Get the id of the process running the job of the log with the given id. An
+error is returned if the pid file is not locked, as the process that wrote it
+no longer runs the job and its id may have been reused by another process
+*/
+func readPidFile(path, logId string) (int, error) {
+	file, err := os.Open(pidFilePath(path, logId))
 	if err != nil {
-		return []Log{}, err
+		return 0, err
 	}
+	defer file.Close()
 
-	return *logs, nil
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return 0, errors.New("Pid file of log " + logId + " is stale")
+	}
+	if err != syscall.EWOULDBLOCK {
+		return 0, err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+/*
+Load all logs stored locally
+*/
+func loadLogs(path string) ([]Log, error) {
+	return openLogStore(path).Load()
 }
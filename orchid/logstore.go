@@ -0,0 +1,376 @@
+/*
+Persistent storage of log metadata. Logs are stored in an append-only journal,
+allowing several processes to update logs concurrently without losing entries
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+/*
+Type defining a store of log metadata
+*/
+type LogStore interface {
+	// Load all logs in the order they were first saved
+	Load() ([]Log, error)
+
+	// Save a log, replacing any log with the same id
+	Save(log Log) error
+
+	// Delete the log with the given id
+	Delete(logId string) error
+
+	// Update the log with the given id, the log being saved if the update
+	// returns true. No other process can save the log during the update
+	Update(logId string, update func(log *Log) (bool, error)) (Log, error)
+}
+
+/*
+Type defining a log store backed by a journal file. Every save or delete is
+appended to the journal as a single line, the last line for a log id taking
+precedence. All access to the journal is serialized by an exclusive lock on a
+separate lock file, and the journal is compacted by atomically replacing it
+once it holds many outdated entries
+*/
+type JournalLogStore struct {
+	journal string
+	lock    string
+	legacy  string
+}
+
+/*
+Type defining an entry of the journal
+*/
+type journalEntry struct {
+	Deleted bool `json:",omitempty"`
+	Log
+}
+
+/*
+Open the log store of the setup at the given path
+*/
+func openLogStore(path string) LogStore {
+	return JournalLogStore{
+		journal: path + "/logs.journal",
+		lock:    path + "/logs.lock",
+		legacy:  path + "/logs.json",
+	}
+}
+
+/*
+Load all logs in the journal, compacting the journal if needed
+*/
+func (s JournalLogStore) Load() ([]Log, error) {
+	var logs []Log
+	err := s.locked(func() error {
+		var entries int
+		var err error
+		logs, entries, err = s.read()
+		if err != nil {
+			return err
+		}
+
+		if entries > 2*len(logs)+100 {
+			return s.write(logs)
+		}
+		return nil
+	})
+	if err != nil {
+		return []Log{}, err
+	}
+
+	return logs, nil
+}
+
+/*
+Save a log by appending it to the journal
+*/
+func (s JournalLogStore) Save(log Log) error {
+	return s.locked(func() error {
+		return s.append(journalEntry{Log: log})
+	})
+}
+
+/*
+Delete a log by appending a deletion entry to the journal
+*/
+func (s JournalLogStore) Delete(logId string) error {
+	return s.locked(func() error {
+		return s.append(journalEntry{Deleted: true, Log: Log{Id: logId}})
+	})
+}
+
+/*
+Update a log while holding the lock of the journal, so the log cannot change
+between reading it and saving it. The update is given the latest saved log and
+decides whether the log is saved, returning an error if it cannot be applied
+*/
+func (s JournalLogStore) Update(logId string, update func(log *Log) (bool, error)) (Log, error) {
+	var log Log
+	err := s.locked(func() error {
+		logs, _, err := s.read()
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, l := range logs {
+			if l.Id == logId {
+				log = l
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("Log not found")
+		}
+
+		changed, err := update(&log)
+		if err != nil || !changed {
+			return err
+		}
+		return s.append(journalEntry{Log: log})
+	})
+	if err != nil {
+		return Log{}, err
+	}
+
+	return log, nil
+}
+
+/*
+Run a function while holding the exclusive lock of the journal. Before running
+the function, logs in the legacy logs.json file are migrated to the journal
+*/
+func (s JournalLogStore) locked(f func() error) error {
+	lock, err := os.OpenFile(s.lock, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	err = s.migrate()
+	if err != nil {
+		return err
+	}
+
+	return f()
+}
+
+/*
+Migrate the logs stored in the legacy logs.json file to the journal, if the
+journal does not exist yet. The legacy file is kept as logs.json.migrated
+*/
+func (s JournalLogStore) migrate() error {
+	if _, err := os.Stat(s.journal); err == nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	logs := []Log{}
+	err = json.Unmarshal(data, &logs)
+	if err != nil {
+		return err
+	}
+
+	err = s.write(logs)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(s.legacy, s.legacy+".migrated")
+}
+
+/*
+Read the journal, returning the current logs and the number of entries read
+*/
+func (s JournalLogStore) read() ([]Log, int, error) {
+	file, err := os.Open(s.journal)
+	if os.IsNotExist(err) {
+		return []Log{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	logs := []Log{}
+	indices := map[string]int{}
+	entries := 0
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+
+		// A line without a terminating newline is the remains of an
+		// interrupted write and is ignored
+		if err == io.EOF {
+			break
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		// A line that cannot be decoded is skipped rather than making
+		// every log unreadable. It is counted as an entry, so it is
+		// dropped once the journal is compacted
+		entries++
+		var entry journalEntry
+		if json.Unmarshal(line, &entry) != nil {
+			continue
+		}
+
+		i, exists := indices[entry.Id]
+		if entry.Deleted {
+			if exists {
+				logs = append(logs[:i], logs[i+1:]...)
+				delete(indices, entry.Id)
+				for id, j := range indices {
+					if j > i {
+						indices[id] = j - 1
+					}
+				}
+			}
+			continue
+		}
+
+		if exists {
+			logs[i] = entry.Log
+		} else {
+			indices[entry.Id] = len(logs)
+			logs = append(logs, entry.Log)
+		}
+	}
+
+	return logs, entries, nil
+}
+
+/*
+Append an entry to the journal
+*/
+func (s JournalLogStore) append(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.journal, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Drop the remains of an interrupted write, so they never become part
+	// of a complete line
+	err = truncateIncompleteLine(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+/*
+Truncate the journal after its last complete line, removing any partial line
+left by an interrupted write
+*/
+func truncateIncompleteLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Search backwards for the last newline, a block at a time
+	end := info.Size()
+	block := make([]byte, 4096)
+	for offset := end; offset > 0; {
+		size := int64(len(block))
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		_, err = file.ReadAt(block[:size], offset)
+		if err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(block[:size], '\n'); i >= 0 {
+			if offset+int64(i)+1 == end {
+				return nil
+			}
+			return file.Truncate(offset + int64(i) + 1)
+		}
+	}
+	if end == 0 {
+		return nil
+	}
+	return file.Truncate(0)
+}
+
+/*
+Replace the journal with one holding a single entry per log. The new journal is
+written to a temporary file which is then renamed, ensuring the journal is
+never left partially written
+*/
+func (s JournalLogStore) write(logs []Log) error {
+	tmp := s.journal + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, log := range logs {
+		data, err := json.Marshal(journalEntry{Log: log})
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, s.journal)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+/*
+Count the lines of the journal of the setup at the given path
+*/
+func journalLines(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path + "/logs.journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestLogStoreLastEntryWins(t *testing.T) {
+	dir := t.TempDir()
+	store := openLogStore(dir)
+
+	for _, log := range []Log{{Id: "a", Status: "Running"}, {Id: "b", Status: "Running"}, {Id: "a", Status: "Finished"}} {
+		if err := store.Save(log); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].Id != "a" || logs[0].Status != "Finished" {
+		t.Fatalf("Expected only the last save of log a, got %+v", logs)
+	}
+}
+
+func TestLogStoreConcurrentSaves(t *testing.T) {
+	dir := t.TempDir()
+	store := openLogStore(dir)
+
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			log := Log{Id: fmt.Sprint("log", i)}
+			for j := 0; j < 5; j++ {
+				log.Status = fmt.Sprint(j)
+				if err := store.Save(log); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	logs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 20 {
+		t.Fatalf("Expected 20 logs, got %d", len(logs))
+	}
+	for _, log := range logs {
+		if log.Status != "4" {
+			t.Fatalf("Expected the last save of every log to win, got %+v", log)
+		}
+	}
+}
+
+func TestLogStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store := openLogStore(dir)
+
+	for i := 0; i < 150; i++ {
+		if err := store.Save(Log{Id: "a", Status: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := journalLines(t, dir); lines != 150 {
+		t.Fatalf("Expected every save to be appended, got %d lines", lines)
+	}
+
+	logs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].Status != "149" {
+		t.Fatalf("Expected the last save to win, got %+v", logs)
+	}
+	if lines := journalLines(t, dir); lines != 1 {
+		t.Fatalf("Expected the journal to be compacted, got %d lines", lines)
+	}
+}
+
+func TestLogStoreIncompleteLine(t *testing.T) {
+	dir := t.TempDir()
+	store := openLogStore(dir)
+	if err := store.Save(Log{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a save interrupted halfway through writing its line
+	file, err := os.OpenFile(dir+"/logs.journal", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Id":"b","Sta`)
+	file.Close()
+
+	if err := store.Save(Log{Id: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].Id != "a" || logs[1].Id != "c" {
+		t.Fatalf("Expected the incomplete line to be dropped, got %+v", logs)
+	}
+
+	if err := ioutil.WriteFile(dir+"/logs.journal", []byte("{bad\n{\"Id\":\"d\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logs, err = store.Load()
+	if err != nil || len(logs) != 1 || logs[0].Id != "d" {
+		t.Fatalf("Expected the undecodable line to be skipped, got %+v, %v", logs, err)
+	}
+}
+
+func TestLogStoreMigration(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `[{"Id":"a","JobId":"j","Status":"Finished"},{"Id":"b","JobId":"j","Status":"Error"}]`
+	if err := ioutil.WriteFile(dir+"/logs.json", []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := openLogStore(dir)
+	if err := store.Save(Log{Id: "c", JobId: "j", Status: "Running"}); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3 || logs[0].Id != "a" || logs[1].Status != "Error" || logs[2].Id != "c" {
+		t.Fatalf("Expected the legacy logs followed by the new log, got %+v", logs)
+	}
+
+	if _, err := os.Stat(dir + "/logs.json"); !os.IsNotExist(err) {
+		t.Fatal("Expected logs.json to be renamed once migrated")
+	}
+	if _, err := os.Stat(dir + "/logs.json.migrated"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogStoreUpdate(t *testing.T) {
+	dir := t.TempDir()
+	store := openLogStore(dir)
+	if err := store.Save(Log{Id: "a", Status: "Queued"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Of several processes starting the same queued log only one succeeds
+	var wait sync.WaitGroup
+	started := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, err := store.Update("a", func(log *Log) (bool, error) {
+				if log.Status != "Queued" {
+					return false, fmt.Errorf("Log is %s", log.Status)
+				}
+				log.Status = "Running"
+				return true, nil
+			})
+			started <- err == nil
+		}()
+	}
+	wait.Wait()
+	close(started)
+
+	count := 0
+	for ok := range started {
+		if ok {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("Expected the log to be started once, got %d", count)
+	}
+
+	if _, err := store.Update("b", func(log *Log) (bool, error) { return true, nil }); err == nil {
+		t.Fatal("Expected updating an unknown log to fail")
+	}
+}
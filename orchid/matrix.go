@@ -0,0 +1,321 @@
+/*
+Definition of and methods for expanding, validating and running the matrix of a
+job, which runs the steps of the job once for each combination of the values of
+its axes
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Type defining the matrix of a job. The variants of the matrix are every
+combination of the values of the axes, apart from those matching any of the
+Exclude entries, followed by the Include entries. An Exclude entry matches a
+variant if the variant has all of the values it gives, while an Include entry
+gives a value for every axis
+*/
+type Matrix struct {
+	Axes    map[string][]string
+	Exclude []map[string]string
+	Include []map[string]string
+}
+
+/*
+Type defining the state of the pipeline of a variant while it runs: the
+pipeline of the job it is a variant of, its index among the variants, the mutex
+guarding the log of the job, and the writer prefixing its output by its id
+*/
+type variantState struct {
+	parent *Pipeline
+	index  int
+	mutex  *sync.Mutex
+	prefix *PrefixWriter
+}
+
+/*
+Get the names of the axes of the matrix, sorted by name
+*/
+func (m *Matrix) axes() []string {
+	if m == nil {
+		return nil
+	}
+	names := []string{}
+	for name := range m.Axes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Get the values of the axes of each variant of the matrix, in order. Variants
+are ordered by the values of the axes in the order they are given, with the
+axes sorted by name, followed by the included variants
+*/
+func (m *Matrix) expand() []map[string]string {
+	variants := []map[string]string{{}}
+	for _, axis := range m.axes() {
+		expanded := []map[string]string{}
+		for _, variant := range variants {
+			for _, value := range m.Axes[axis] {
+				values := map[string]string{axis: value}
+				for name, value := range variant {
+					values[name] = value
+				}
+				expanded = append(expanded, values)
+			}
+		}
+		variants = expanded
+	}
+
+	included := []map[string]string{}
+	ids := map[string]bool{}
+	for _, variant := range variants {
+		if !m.excluded(variant) {
+			included = append(included, variant)
+			ids[variantId(variant)] = true
+		}
+	}
+	for _, variant := range m.Include {
+		if !ids[variantId(variant)] {
+			included = append(included, variant)
+			ids[variantId(variant)] = true
+		}
+	}
+	return included
+}
+
+/*
+Check whether the variant with the given values matches any Exclude entry
+*/
+func (m *Matrix) excluded(values map[string]string) bool {
+	for _, exclude := range m.Exclude {
+		matches := true
+		for name, value := range exclude {
+			if values[name] != value {
+				matches = false
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Get the id of the variant with the given values, of the form
+<axis>=<value>,<axis>=<value> with the axes sorted by name
+*/
+func variantId(values map[string]string) string {
+	parts := []string{}
+	for _, name := range sortedKeys(values) {
+		parts = append(parts, name+"="+values[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+/*
+Validate the matrix of the job at the given path, if it has one. The axes are
+passed to the steps as parameters, so their names must be valid environment
+variable names distinct from the parameters of the job
+*/
+func validateMatrix(v *Validator, at string, job Job) {
+	if job.Matrix == nil {
+		return
+	}
+
+	at = fieldPath(at, "Matrix")
+	axes := job.Matrix.axes()
+	if len(axes) == 0 {
+		v.report(jobsFile, fieldPath(at, "Axes"), "", "Job '"+job.Id+"' must have a Matrix with at least one axis")
+		return
+	}
+
+	parameters := []string{}
+	for _, parameter := range job.Parameters {
+		parameters = append(parameters, parameter.Name)
+	}
+
+	for _, axis := range axes {
+		axisAt := fieldPath(fieldPath(at, "Axes"), axis)
+		if !variableName.MatchString(axis) || strings.HasPrefix(axis, builtinPrefix) {
+			v.report(jobsFile, axisAt, axis, "Job '"+job.Id+"' contains invalid matrix axis name '"+axis+"'")
+		} else if contains(parameters, axis) {
+			v.report(jobsFile, axisAt, axis, "Job '"+job.Id+"' contains matrix axis '"+axis+"', but it also has a parameter with that name")
+		}
+		if len(job.Matrix.Axes[axis]) == 0 {
+			v.report(jobsFile, axisAt, "", "Matrix axis '"+axis+"' of job '"+job.Id+"' must have at least one value")
+		}
+		seen := map[string]bool{}
+		for i, value := range job.Matrix.Axes[axis] {
+			if seen[value] {
+				v.report(jobsFile, indexPath(axisAt, i), value, "Matrix axis '"+axis+"' of job '"+job.Id+"' contains the value '"+value+"' more than once")
+			}
+			seen[value] = true
+		}
+	}
+
+	for i, exclude := range job.Matrix.Exclude {
+		excludeAt := indexPath(fieldPath(at, "Exclude"), i)
+		if len(exclude) == 0 {
+			v.report(jobsFile, excludeAt, "", "Matrix of job '"+job.Id+"' must not have an empty Exclude entry, as it would exclude every variant")
+		}
+		for _, axis := range sortedKeys(exclude) {
+			if !contains(axes, axis) {
+				v.reportUnknown(jobsFile, fieldPath(excludeAt, axis), axis, "Matrix of job '"+job.Id+"' has an Exclude entry referring to unknown axis '"+axis+"'", axes)
+			} else if !contains(job.Matrix.Axes[axis], exclude[axis]) {
+				v.reportUnknown(jobsFile, fieldPath(excludeAt, axis), exclude[axis], "Matrix of job '"+job.Id+"' has an Exclude entry with value '"+exclude[axis]+"' not among the values of axis '"+axis+"'", job.Matrix.Axes[axis])
+			}
+		}
+	}
+
+	for i, include := range job.Matrix.Include {
+		includeAt := indexPath(fieldPath(at, "Include"), i)
+		for _, axis := range sortedKeys(include) {
+			if !contains(axes, axis) {
+				v.reportUnknown(jobsFile, fieldPath(includeAt, axis), axis, "Matrix of job '"+job.Id+"' has an Include entry referring to unknown axis '"+axis+"'", axes)
+			}
+		}
+		for _, axis := range axes {
+			if _, exists := include[axis]; !exists {
+				v.report(jobsFile, includeAt, "", "Matrix of job '"+job.Id+"' has an Include entry without a value for axis '"+axis+"'")
+			}
+		}
+	}
+
+	if len(job.Matrix.expand()) == 0 {
+		v.report(jobsFile, fieldPath(at, "Exclude"), "", "Matrix of job '"+job.Id+"' excludes every variant")
+	}
+}
+
+/*
+Build the pipeline of the variant of the job at the given index, with the given
+values of the axes. The values are passed to the steps of the variant as
+parameters, along with the parameters of the job, and the lines written by the
+variant are prefixed by its id
+*/
+func (p *Pipeline) buildVariant(index int, values map[string]string) (Pipeline, error) {
+	id := variantId(values)
+	parameters := map[string]string{}
+	for name, value := range p.Log.Parameters {
+		parameters[name] = value
+	}
+	for name, value := range values {
+		parameters[name] = value
+	}
+
+	var variant Pipeline
+	variant.Log = Log{Id: id, JobId: p.Log.JobId, Status: "Pending", Parameters: values}
+	variant.variant.index = index
+	variant.variant.prefix = newPrefixWriter("["+id+"] ", p.Output)
+	variant.Output = newSyncWriter(variant.variant.prefix)
+	variant.builder = p.builder
+	variant.builder.log.Parameters = parameters
+	variant.builder.output = variant.Output
+	variant.builder.extra = map[string]string{"ORCHID_VARIANT": id}
+
+	var err error
+	variant.Steps, variant.Log.Steps, err = variant.builder.buildSteps()
+	if err != nil {
+		return Pipeline{}, err
+	}
+	variant.Log.OnFailure = handlerLogs(p.builder.job.OnFailure, parameters)
+	variant.Log.Finally = handlerLogs(p.builder.job.Finally, parameters)
+	return variant, nil
+}
+
+/*
+Run the variants of the job concurrently, each running its steps followed by
+its handlers. A failing variant does not stop the other variants. Returns the
+error of the first failing variant, or the error of the context if it is done
+*/
+func (p *Pipeline) runVariants(ctx context.Context, path string) error {
+	mutex := &sync.Mutex{}
+	errs := make([]error, len(p.Variants))
+
+	var wait sync.WaitGroup
+	for i := range p.Variants {
+		variant := &p.Variants[i]
+		variant.variant.parent = p
+		variant.variant.mutex = mutex
+		variant.Abort = p.Abort
+
+		wait.Add(1)
+		go func(i int, variant *Pipeline) {
+			defer wait.Done()
+			errs[i] = variant.runVariant(ctx, path)
+		}(i, variant)
+	}
+	wait.Wait()
+
+	failed := []string{}
+	var failure error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, p.Variants[i].Log.Id)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(p.Output, "Failed in %d of %d variants: %s\n", len(failed), len(p.Variants), strings.Join(failed, " "))
+	}
+	if failure != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return failure
+}
+
+/*
+Run the steps and handlers of a variant, recording its status in its log
+*/
+func (p *Pipeline) runVariant(ctx context.Context, path string) error {
+	p.Log.StartTime = time.Now()
+	p.Log.Status = "Running"
+	p.saveLog(path)
+
+	err := p.runSteps(ctx, path)
+	err = p.runHandlers(path, err)
+	p.variant.prefix.Flush()
+
+	p.Log.EndTime = time.Now()
+	switch err {
+	case nil:
+		p.Log.Status = "Finished"
+	case context.DeadlineExceeded:
+		p.Log.Status = "TimedOut"
+	case context.Canceled:
+		p.Log.Status = "Cancelled"
+	default:
+		p.Log.Status = "Error"
+	}
+	p.saveLog(path)
+	return err
+}
+
+/*
+Save the log of a variant as part of the log of the job. The logs of the steps
+are copied, as the variant keeps updating them while the log of the job may be
+saved by other variants
+*/
+func (p *Pipeline) saveVariant(path string) {
+	log := p.Log
+	log.Steps = append([]StepLog{}, p.Log.Steps...)
+	log.OnFailure = append([]StepLog{}, p.Log.OnFailure...)
+	log.Finally = append([]StepLog{}, p.Log.Finally...)
+
+	p.variant.mutex.Lock()
+	defer p.variant.mutex.Unlock()
+	p.variant.parent.Log.Variants[p.variant.index] = log
+	p.variant.parent.saveLog(path)
+}
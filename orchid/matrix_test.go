@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+/*
+Get the ids of the variants of the matrix, in order
+*/
+func variantIds(m *Matrix) []string {
+	ids := []string{}
+	for _, values := range m.expand() {
+		ids = append(ids, variantId(values))
+	}
+	return ids
+}
+
+func TestMatrixExpand(t *testing.T) {
+	matrix := &Matrix{
+		Axes: map[string][]string{
+			"GO":  {"1.21", "1.22"},
+			"ENV": {"staging", "prod"},
+		},
+	}
+	expected := []string{
+		"ENV=staging,GO=1.21",
+		"ENV=staging,GO=1.22",
+		"ENV=prod,GO=1.21",
+		"ENV=prod,GO=1.22",
+	}
+	if ids := variantIds(matrix); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected variants %v, got %v", expected, ids)
+	}
+}
+
+func TestMatrixExcludeAndInclude(t *testing.T) {
+	matrix := &Matrix{
+		Axes: map[string][]string{
+			"GO":  {"1.21", "1.22"},
+			"ENV": {"staging", "prod"},
+		},
+		Exclude: []map[string]string{
+			{"GO": "1.21", "ENV": "prod"},
+			{"ENV": "staging", "GO": "1.22"},
+		},
+		Include: []map[string]string{
+			{"GO": "1.23", "ENV": "dev"},
+			{"GO": "1.21", "ENV": "staging"},
+		},
+	}
+	expected := []string{
+		"ENV=staging,GO=1.21",
+		"ENV=prod,GO=1.22",
+		"ENV=dev,GO=1.23",
+	}
+	if ids := variantIds(matrix); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected variants %v, got %v", expected, ids)
+	}
+
+	// An Exclude entry giving only some axes excludes every variant with
+	// those values
+	matrix.Exclude = []map[string]string{{"ENV": "prod"}}
+	matrix.Include = nil
+	expected = []string{"ENV=staging,GO=1.21", "ENV=staging,GO=1.22"}
+	if ids := variantIds(matrix); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected variants %v, got %v", expected, ids)
+	}
+}
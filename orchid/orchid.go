@@ -7,10 +7,13 @@ server.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
         "path/filepath"
+	"strings"
         "log"
 )
 
@@ -26,9 +29,17 @@ func main() {
 
 	// Handle flags and arguments
 	var path string
-	flag.StringVar(&path, "-p", "orchid", "Specify the path to the config directory")
+	var jsonOutput bool
+	var eventJSON string
+	flag.StringVar(&path, "p", "orchid", "Specify the path to the config directory")
+	flag.BoolVar(&jsonOutput, "json", false, "Print lists and logs as JSON")
+	flag.StringVar(&eventJSON, "event", "", "The event causing the job to run as JSON, recorded in its log")
 	flag.Parse()
 	var args = flag.Args()
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
 
         currentdir, err := filepath.Abs(filepath.Dir(os.Args[0]))
         if err != nil {
@@ -36,20 +47,103 @@ func main() {
         }
         path = currentdir + "/" + path
 
-	actions := Actions{path}
+	actions := Actions{path: path, json: jsonOutput}
 
 	// Create logs dir if it does not exist
 	os.Mkdir("orchid/logs", 0744)
 
-	// Run job
-	if args[0] == "run" {
-		if len(args) != 2 {
+	// Run or queue job
+	if args[0] == "run" || args[0] == "queue" {
+		if len(args) < 2 {
 			printUsage()
 			return
 		}
 
+		parameters := map[string]string{}
+		for _, arg := range args[2:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				fmt.Println("ERROR: Invalid parameter '" + arg + "', expected <name>=<value>")
+				os.Exit(1)
+			}
+			parameters[parts[0]] = parts[1]
+		}
+
+		var event *Event
+		if eventJSON != "" {
+			event = &Event{}
+			err := json.Unmarshal([]byte(eventJSON), event)
+			if err != nil {
+				fmt.Println("ERROR: Invalid event: " + err.Error())
+				os.Exit(1)
+			}
+		}
+
 		jobId := args[1]
-		actions.RunJob(jobId)
+		if args[0] == "queue" {
+			err := actions.QueueJob(jobId, parameters, event)
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+				os.Exit(1)
+			}
+		} else {
+			actions.RunJob(jobId, parameters, event)
+		}
+	}
+
+	// Validate the configuration
+	if args[0] == "validate" {
+		if len(args) != 1 {
+			printUsage()
+			return
+		}
+
+		// The problems have been printed already, and the JSON output
+		// must not be followed by anything else
+		err := actions.Validate()
+		if err != nil {
+			if !jsonOutput {
+				fmt.Println("ERROR: " + err.Error())
+			}
+			os.Exit(1)
+		}
+	}
+
+	// Convert the configuration files to another format
+	if args[0] == "config" {
+		if len(args) != 4 || args[1] != "convert" || args[2] != "--to" {
+			printUsage()
+			return
+		}
+
+		err := actions.ConvertConfig(args[3])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Show running jobs and locks
+	if args[0] == "status" {
+		err := actions.Status()
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Start queued job
+	if args[0] == "start" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.StartLog(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			os.Exit(1)
+		}
 	}
 
 	// Execute action
@@ -60,7 +154,11 @@ func main() {
 		}
 
 		actionId := args[1]
-		actions.ExecuteAction(actionId)
+		err := actions.ExecuteAction(actionId)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			os.Exit(1)
+		}
 	}
 
 	// List
@@ -79,19 +177,50 @@ func main() {
 		} else if args[1] == "machines" {
 			// List machines
 			actions.ListMachines()
+		} else if args[1] == "groups" {
+			// List groups
+			actions.ListGroups()
+		} else if args[1] == "schedules" {
+			// List schedules with their next run
+			actions.ListSchedules()
+		} else if args[1] == "triggers" {
+			// List triggers
+			actions.ListTriggers()
 		} else if args[1] == "scripts" {
 			// List scripts
 			actions.ListScripts()
 		} else if args[1] == "logs" {
 			// List logs
 			actions.ListLogs()
+		} else if args[1] == "queue" {
+			// List queued jobs with their limits
+			actions.ListQueue()
 		} else {
 			printUsage()
 		}
 	}
 
-	// Get log output
+	// Get log output or prune logs
 	if args[0] == "logs" {
+		if len(args) < 2 {
+			printUsage()
+			return
+		}
+
+		if args[1] == "prune" {
+			if len(args) > 3 || (len(args) == 3 && args[2] != "--dry-run") {
+				printUsage()
+				return
+			}
+
+			err := actions.PruneLogs(len(args) == 3)
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+
 		if len(args) != 2 {
 			printUsage()
 			return
@@ -101,6 +230,74 @@ func main() {
 		actions.GetLogOutput(logId)
 	}
 
+	// Cancel a running job
+	if args[0] == "cancel" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.CancelLog(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Show the metadata of a log
+	if args[0] == "show" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.ShowLog(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Manage the encrypted secrets
+	if args[0] == "secrets" {
+		if len(args) < 2 {
+			printUsage()
+			return
+		}
+
+		var err error
+		if args[1] == "list" && len(args) == 2 {
+			err = actions.ListSecrets()
+		} else if args[1] == "get" && len(args) == 3 {
+			err = actions.GetSecret(args[2])
+		} else if args[1] == "set" && (len(args) == 3 || len(args) == 4) {
+			// Read the value from stdin if it is not given, keeping
+			// it out of the shell history
+			var value string
+			if len(args) == 4 {
+				value = args[3]
+			} else {
+				data, readErr := ioutil.ReadAll(os.Stdin)
+				if readErr != nil {
+					fmt.Println("ERROR: " + readErr.Error())
+					os.Exit(1)
+				}
+				value = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+			}
+			err = actions.SetSecret(args[2], value)
+		} else if args[1] == "rm" && len(args) == 3 {
+			err = actions.RemoveSecret(args[2])
+		} else {
+			printUsage()
+			return
+		}
+
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
 	// SSH into a given machine
 	if args[0] == "ssh" {
 		if len(args) != 2 {
@@ -112,6 +309,20 @@ func main() {
 		actions.SSH(machineId)
 	}
 
+	// Record the host key of a given machine
+	if args[0] == "trust" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Trust(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
 	// Copy files/directories from one machine to another
 	if args[0] == "scp" {
 		if len(args) != 3 {
@@ -154,15 +365,32 @@ func main() {
 Prints a help message, explaining how to use the application
 */
 func printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: orchid [-json] <command>")
 	fmt.Println("- list jobs\t// List all configured jobs")
 	fmt.Println("- list machines\t// List all configured machines")
+	fmt.Println("- list groups\t// List all configured groups of machines")
 	fmt.Println("- list scripts\t// List all configured scripts")
 	fmt.Println("- list logs\t// List all stored logs")
-	fmt.Println("- run <job id>\t// Run the job with the given id")
+	fmt.Println("- list triggers\t// List all triggers")
+	fmt.Println("- list schedules\t// List all schedules and when they run next")
+	fmt.Println("- list queue\t// List the queued jobs and the limits they are subject to")
+	fmt.Println("- validate\t// Check every configuration file, listing all problems found")
+	fmt.Println("- config convert --to <json|yaml|toml>\t// Convert the configuration files to the given format")
+	fmt.Println("- run <job id> [<name>=<value> ...]\t// Run the job with the given id and parameters")
+	fmt.Println("- queue <job id> [<name>=<value> ...]\t// Queue the job with the given id to be run by the server")
+	fmt.Println("- start <log id>\t// Run the queued job of the log with the given id")
+	fmt.Println("- status\t// Show running and queued jobs, and who holds each lock")
 	fmt.Println("- exec <action id>\t// Execute the action with the given id")
 	fmt.Println("- logs <log id>\t// Tail the log with the given id")
+	fmt.Println("- logs prune [--dry-run]\t// Delete the logs not to be kept according to the retention policy")
+	fmt.Println("- cancel <log id>\t// Cancel the running job of the log with the given id")
+	fmt.Println("- show <log id>\t// Show the status, exit code and duration of each step of the log with the given id")
+	fmt.Println("- secrets list\t// List the names of all secrets")
+	fmt.Println("- secrets get <name>\t// Print the value of the secret with the given name")
+	fmt.Println("- secrets set <name> [<value>]\t// Set the secret with the given name, reading the value from stdin if not given")
+	fmt.Println("- secrets rm <name>\t// Remove the secret with the given name")
 	fmt.Println("- ssh <machine id>\t// SSH into the machine with the given id")
+	fmt.Println("- trust <machine id>\t// Record the host key of the machine with the given id in known_hosts")
 	fmt.Println("- scp <machine id>:<path> <machine id>:<path>\t// Copy files/directories from one machine to another. Only one of the machines can be specified. The other must be a path to a local file / directory without ':'")
         fmt.Println("- mount <machine id> <remote path> <local path>\t// Mount a remote directory (to which you have read access) locally")
         fmt.Println("- unmount <local path>\t// Unmount a previously Mount'ed directory")
@@ -0,0 +1,166 @@
+/*
+Definition of and methods for validating the parameters of jobs, and for
+passing their values to the steps of a job
+*/
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Pattern matching a reference to a parameter in the arguments of a step
+*/
+var parameterReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+/*
+The types a parameter may have
+*/
+var parameterTypes = []string{"string", "int", "bool"}
+
+/*
+Type defining a parameter of a job. The type is one of "string", "int" and
+"bool", and defaults to "string". If allowed values are given, the value must
+be one of them
+*/
+type Parameter struct {
+	Name     string
+	Type     string
+	Default  string
+	Required bool
+	Allowed  []string
+}
+
+/*
+Validate the parameter definitions of the job at the given path, including
+their defaults. Optional parameters for which an empty value is not valid, such
+as int and bool parameters, must have a default
+*/
+func validateParameters(v *Validator, at string, job Job) {
+	names := map[string]bool{}
+	for i, parameter := range job.Parameters {
+		parameterAt := indexPath(fieldPath(at, "Parameters"), i)
+		if !variableName.MatchString(parameter.Name) || strings.HasPrefix(parameter.Name, builtinPrefix) {
+			v.report(jobsFile, fieldPath(parameterAt, "Name"), parameter.Name, "Job '"+job.Id+"' contains invalid parameter name '"+parameter.Name+"'")
+		} else if names[parameter.Name] {
+			v.report(jobsFile, fieldPath(parameterAt, "Name"), parameter.Name, "Job '"+job.Id+"' contains more than one parameter named '"+parameter.Name+"'")
+		}
+		names[parameter.Name] = true
+
+		if parameter.Type != "" && !contains(parameterTypes, parameter.Type) {
+			v.reportUnknown(jobsFile, fieldPath(parameterAt, "Type"), parameter.Type, "Parameter '"+parameter.Name+"' of job '"+job.Id+"' must have a Type that is either 'string', 'int' or 'bool', got '"+parameter.Type+"'", parameterTypes)
+			continue
+		}
+		for j, allowed := range parameter.Allowed {
+			if err := checkParameterType(parameter, allowed); err != nil {
+				v.report(jobsFile, indexPath(fieldPath(parameterAt, "Allowed"), j), allowed, "Parameter '"+parameter.Name+"' of job '"+job.Id+"' contains invalid allowed value: "+err.Error())
+			}
+		}
+		if parameter.Default != "" {
+			if err := checkParameter(parameter, parameter.Default); err != nil {
+				v.report(jobsFile, fieldPath(parameterAt, "Default"), parameter.Default, "Parameter '"+parameter.Name+"' of job '"+job.Id+"' contains invalid Default: "+err.Error())
+			}
+		} else if !parameter.Required && checkParameter(parameter, "") != nil {
+			// An optional parameter not given takes the value of its
+			// Default, so the empty value must be valid without one
+			v.report(jobsFile, fieldPath(parameterAt, "Name"), parameter.Name, "Parameter '"+parameter.Name+"' of job '"+job.Id+"' must have a Default or be Required, as an empty value is not valid for it")
+		}
+	}
+}
+
+/*
+Check that a value is valid for the parameter
+*/
+func checkParameter(parameter Parameter, value string) error {
+	err := checkParameterType(parameter, value)
+	if err != nil {
+		return err
+	}
+
+	if len(parameter.Allowed) == 0 {
+		return nil
+	}
+	for _, allowed := range parameter.Allowed {
+		if value == allowed {
+			return nil
+		}
+	}
+	return errors.New("Parameter '" + parameter.Name + "' must be one of '" + strings.Join(parameter.Allowed, "', '") + "', got '" + value + "'")
+}
+
+/*
+Check that a value is of the type of the parameter
+*/
+func checkParameterType(parameter Parameter, value string) error {
+	switch parameter.Type {
+	case "int":
+		if _, err := strconv.Atoi(value); err != nil {
+			return errors.New("Parameter '" + parameter.Name + "' must be an integer, got '" + value + "'")
+		}
+	case "bool":
+		if value != "true" && value != "false" {
+			return errors.New("Parameter '" + parameter.Name + "' must be either 'true' or 'false', got '" + value + "'")
+		}
+	}
+	return nil
+}
+
+/*
+Resolve the values of the parameters of a job from the values given when
+running it, using the defaults of parameters not given. Unknown parameters,
+invalid values and missing required parameters are rejected
+*/
+func resolveParameters(job Job, given map[string]string) (map[string]string, error) {
+	definitions := map[string]Parameter{}
+	for _, parameter := range job.Parameters {
+		definitions[parameter.Name] = parameter
+	}
+
+	for name := range given {
+		if _, exists := definitions[name]; !exists {
+			return nil, errors.New("Job '" + job.Id + "' has no parameter named '" + name + "'")
+		}
+	}
+
+	values := map[string]string{}
+	for _, parameter := range job.Parameters {
+		value, exists := given[parameter.Name]
+		if !exists {
+			if parameter.Required {
+				return nil, errors.New("Parameter '" + parameter.Name + "' of job '" + job.Id + "' is required")
+			}
+			values[parameter.Name] = parameter.Default
+			continue
+		}
+
+		err := checkParameter(parameter, value)
+		if err != nil {
+			return nil, err
+		}
+		values[parameter.Name] = value
+	}
+
+	return values, nil
+}
+
+/*
+Substitute references of the form ${name} to the given parameters in the
+arguments of a step. References to unknown parameters are left as they are
+*/
+func substituteParameters(args []string, values map[string]string) []string {
+	substituted := []string{}
+	for _, arg := range args {
+		substituted = append(substituted, parameterReference.ReplaceAllStringFunc(arg, func(reference string) string {
+			name := parameterReference.FindStringSubmatch(reference)[1]
+			if value, exists := values[name]; exists {
+				return value
+			}
+			return reference
+		}))
+	}
+	return substituted
+}
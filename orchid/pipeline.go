@@ -6,63 +6,407 @@ logging
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 )
 
 /*
-Type defining the pipeline
+Type defining the pipeline. The pipeline of a job with a matrix has no steps of
+its own, but runs a pipeline for each variant of the matrix. The handlers of the
+job are not stopped by the cancellation or timeout of the job, only once the
+abort context is done, if one is given
 */
 type Pipeline struct {
-	Cmds []*exec.Cmd
-	Log  Log
-	File *os.File
+	Steps       []Step
+	Variants    []Pipeline
+	Log         Log
+	File        *os.File
+	Output      *SyncWriter
+	Timeout     time.Duration
+	Locks       []string
+	LockTimeout time.Duration
+	Abort       context.Context
+	builder     stepBuilder
+	variant     variantState
 }
 
 /*
-Run/execute the pipeline, executing the commands it containes sequentially,
-aborting if an error is encountered. This includes updating the logs file.
+Type defining a step of the pipeline. A step is started once all the steps it
+needs have finished
 */
-func (p Pipeline) Run(path string) {
+type Step struct {
+	Id      string
+	Index   int
+	Needs   []string
+	When    *Condition
+	Cmd     Command
+	Out     io.Writer
+	Prefix  *PrefixWriter
+	Redact  *RedactWriter
+	Timeout time.Duration
+	Retry   RetryPolicy
+}
+
+/*
+Type defining how many times a failing step is retried and how long to wait
+between attempts
+*/
+type RetryPolicy struct {
+	Retries     int
+	Delay       time.Duration
+	Exponential bool
+}
+
+/*
+Type defining the result of running a step
+*/
+type stepResult struct {
+	step     Step
+	err      error
+	end      time.Time
+	status   string
+	attempts int
+	machines []MachineLog
+	touched  []string
+}
+
+/*
+Type defining a command in the pipeline, executed either locally or on a remote
+machine. Running the command blocks until it has finished, or until the context
+is cancelled, in which case the command is killed
+*/
+type Command interface {
+	Run(ctx context.Context) error
+}
+
+/*
+Run/execute the pipeline of a started log, executing each step once the steps
+it needs have finished, aborting if an error is encountered or the context is
+cancelled. The handlers of the job are run once the steps have finished. Jobs
+with a matrix run every variant this way concurrently. This includes updating
+the logs file.
+*/
+func (p Pipeline) Run(ctx context.Context, path string) {
 	// Always close the file after use
 	defer p.File.Close()
 
 	var err error
 
-	// Write to the logs file that the job has started
-	p.Log, err = p.Log.start(path)
-	if err != nil {
-		p.File.Close()
-		p.Log.error(path, p.File)
-		return
-	}
-
-	// Run the commands
-	for i, cmd := range p.Cmds {
-		err = cmd.Start()
-		if err != nil {
-			fmt.Fprintf(p.File, "ERROR: Failed to run script %d\n", i)
-			p.Log.error(path, p.File)
+	// Wait for the locks of the job before running any steps
+	if len(p.Locks) > 0 {
+		locks, err := acquireLocks(ctx, path, p.Locks, p.Log, p.LockTimeout, p.Output)
+		if err == context.Canceled {
+			cancelLog(p.Log, path, p.File)
 			return
 		}
-		err = cmd.Wait()
 		if err != nil {
-			fmt.Println("Failed to wait for cmd")
-			fmt.Fprintf(p.File, "ERROR: Failed to wait for script %d to finish\n", i)
-			p.Log.error(path, p.File)
+			fmt.Fprintf(p.Output, "ERROR: Failed to acquire locks: %s\n", err.Error())
+			errorLog(p.Log, path, p.File)
 			return
 		}
+		defer releaseLocks(locks)
+	}
+
+	// Run the steps, enforcing the deadline of the job if it has one
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	if len(p.Variants) > 0 {
+		err = p.runVariants(ctx, path)
+	} else {
+		err = p.runSteps(ctx, path)
+		err = p.runHandlers(path, err)
+	}
+	if err == context.DeadlineExceeded {
+		timedOutLog(p.Log, path, p.File)
+		return
+	}
+	if err == context.Canceled {
+		cancelLog(p.Log, path, p.File)
+		return
+	}
+	if err != nil {
+		errorLog(p.Log, path, p.File)
+		return
 	}
 
 	// Write to the logs file that the job has finished, terminating
 	// any tails following the log, once the job has finished
-	p.Log, _ = p.Log.finish(path, p.File)
+	p.Log, _ = finishLog(p.Log, path, p.File)
 	//TODO find a way of handling the error that might be thrown
 }
 
+/*
+Run the steps of the pipeline, starting steps concurrently as soon as the steps
+they need have finished. A step needing a skipped step is skipped as well,
+unless its own condition decides whether it runs. Once a step fails no further
+steps are started, but steps already running are waited for, and the steps
+never started are skipped. Returns context.DeadlineExceeded if a step failed by
+timing out, and context.Canceled if a step was cancelled. The error of the
+context is returned if it is done before every step has been started
+*/
+func (p *Pipeline) runSteps(ctx context.Context, path string) error {
+	dag := isDAG(p.builder.job)
+	finished := map[string]bool{}
+	skipped := map[string]bool{}
+	started := map[string]bool{}
+	results := make(chan stepResult)
+	running := 0
+
+	var failure error
+	for {
+		// Start every step that is ready, unless a step has failed or
+		// the pipeline has been cancelled. Skipping a step may make
+		// further steps ready, so steps are checked until none are
+		progress := true
+		for progress && failure == nil && ctx.Err() == nil {
+			progress = false
+			for _, step := range p.Steps {
+				if started[step.Id] || !step.ready(finished) {
+					continue
+				}
+
+				started[step.Id] = true
+				run, err := p.checkCondition(path, &p.Log.Steps[step.Index], "step "+step.Id, step)
+				if err != nil {
+					failure = err
+					break
+				}
+				if run && dag && step.When == nil && step.needsAny(skipped) {
+					run = false
+					p.Log.Steps[step.Index].Status = "Skipped"
+					p.saveLog(path)
+				}
+				if !run {
+					finished[step.Id] = true
+					skipped[step.Id] = true
+					progress = true
+					continue
+				}
+
+				running++
+				p.Log.Steps[step.Index].StartTime = time.Now()
+				p.Log.Steps[step.Index].Status = "Running"
+				p.saveLog(path)
+
+				go func(step Step) {
+					results <- step.run(ctx)
+				}(step)
+			}
+		}
+
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+
+		err := p.finishStep(path, &p.Log.Steps[result.step.Index], "Step "+result.step.Id, result)
+		if err != nil {
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		finished[result.step.Id] = true
+	}
+
+	// Steps never started because a step failed or the pipeline was
+	// cancelled are skipped. A job cancelled or timed out between steps
+	// must not be taken to have succeeded
+	if len(started) < len(p.Steps) {
+		for _, step := range p.Steps {
+			if !started[step.Id] {
+				p.Log.Steps[step.Index].Status = "Skipped"
+			}
+		}
+		p.saveLog(path)
+		if failure == nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return failure
+}
+
+/*
+Evaluate the condition of a step, described by the given name, against the log
+of the pipeline. Steps whose condition is false are skipped, recording them as
+skipped in their log. A condition that cannot be evaluated fails the step. The
+parameters and event are taken from the log the steps were built with, as the
+log of a variant only holds the values of its matrix axes
+*/
+func (p *Pipeline) checkCondition(path string, stepLog *StepLog, name string, step Step) (bool, error) {
+	if step.When == nil {
+		return true, nil
+	}
+
+	log := p.builder.log
+	log.Steps = p.Log.Steps
+	run, err := step.When.evaluate(log)
+	if err != nil {
+		fmt.Fprintf(p.Output, "ERROR: Failed to evaluate the condition of %s: %s\n", name, err.Error())
+		stepLog.ExitCode = -1
+		stepLog.Status = "Failed"
+		p.saveLog(path)
+		return false, err
+	}
+	if !run {
+		stepLog.Status = "Skipped"
+		p.saveLog(path)
+	}
+	return run, nil
+}
+
+/*
+Record the result of a step in its log, saving the log and writing any failure
+of the step, described by the given name, to the log output. Returns
+context.DeadlineExceeded if the step timed out, context.Canceled if it was
+cancelled, and the error of the step if it failed otherwise
+*/
+func (p *Pipeline) finishStep(path string, stepLog *StepLog, name string, result stepResult) error {
+	status := exitStatus(result.err)
+	stepLog.EndTime = result.end
+	stepLog.ExitCode = status
+	stepLog.Attempts = result.attempts
+	stepLog.Status = result.status
+	if result.machines != nil {
+		stepLog.Machines = result.machines
+		stepLog.Touched = result.touched
+	}
+	p.saveLog(path)
+
+	switch {
+	case result.status == "TimedOut":
+		fmt.Fprintf(p.Output, "ERROR: %s timed out\n", name)
+		return context.DeadlineExceeded
+	case result.status == "Cancelled":
+		fmt.Fprintf(p.Output, "ERROR: %s was cancelled\n", name)
+		return context.Canceled
+	case result.err != nil && status < 0:
+		fmt.Fprintf(p.Output, "ERROR: Failed to run %s: %s\n", strings.ToLower(name[:1])+name[1:], result.err.Error())
+		return result.err
+	case result.err != nil:
+		fmt.Fprintf(p.Output, "ERROR: %s exited with status %d\n", name, status)
+		return result.err
+	}
+	return nil
+}
+
+/*
+Run the step, retrying it according to its retry policy until it succeeds.
+Attempts are not retried once the given context is done
+*/
+func (s Step) run(ctx context.Context) stepResult {
+	attempts := s.Retry.Retries + 1
+	delay := s.Retry.Delay
+
+	var result stepResult
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempts > 1 {
+			fmt.Fprintf(s.Out, "-----Attempt %d of %d-----\n", attempt, attempts)
+		}
+
+		result = s.runAttempt(ctx)
+		result.attempts = attempt
+		if result.err == nil || ctx.Err() != nil || attempt == attempts {
+			break
+		}
+
+		// Wait before the next attempt, doubling the delay every time if
+		// the backoff is exponential
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if s.Retry.Exponential {
+			delay *= 2
+		}
+	}
+
+	return result
+}
+
+/*
+Run a single attempt of the step, enforcing the timeout of the step and the
+deadline of the given context
+*/
+func (s Step) runAttempt(ctx context.Context) stepResult {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	err := s.Cmd.Run(ctx)
+	if s.Prefix != nil {
+		s.Prefix.Flush()
+	}
+	if s.Redact != nil {
+		s.Redact.Flush()
+	}
+
+	status := "Ok"
+	if err != nil {
+		status = contextStatus(ctx)
+	}
+	result := stepResult{step: s, err: err, end: time.Now(), status: status}
+	if fanOut, ok := s.Cmd.(*FanOut); ok {
+		result.machines = fanOut.Results
+		result.touched = fanOut.Touched
+	}
+	return result
+}
+
+/*
+Save the log of the pipeline, writing any error to the log output. The log of a
+variant is saved as part of the log of the job
+*/
+func (p *Pipeline) saveLog(path string) {
+	if p.variant.parent != nil {
+		p.saveVariant(path)
+		return
+	}
+
+	err := saveLog(p.Log, path)
+	if err != nil {
+		fmt.Fprintf(p.Output, "ERROR: Failed to save log: %s\n", err.Error())
+	}
+}
+
+/*
+Check whether all the steps needed by the step have finished
+*/
+func (s Step) ready(finished map[string]bool) bool {
+	for _, need := range s.Needs {
+		if !finished[need] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Check whether the step needs any of the given steps
+*/
+func (s Step) needsAny(steps map[string]bool) bool {
+	for _, need := range s.Needs {
+		if steps[need] {
+			return true
+		}
+	}
+	return false
+}
+
 /*
 Build a pipeline from a job
 */
@@ -72,18 +416,14 @@ func buildPipeline(path, jobId string, log Log) (Pipeline, error) {
 		return Pipeline{}, err
 	}
 
-	var job Job
-	jobFound := false
-	for _, j := range setup.Jobs {
-		if j.Id == jobId {
-			job = j
-			jobFound = true
-			break
-		}
+	job, err := findJob(setup, jobId)
+	if err != nil {
+		return Pipeline{}, err
 	}
 
-	if !jobFound {
-		return Pipeline{}, errors.New("Job not found")
+	secrets, err := openSecrets(path)
+	if err != nil {
+		return Pipeline{}, err
 	}
 
 	logPath := fmt.Sprintf("%s/logs/%s", path, log.Id)
@@ -92,54 +432,247 @@ func buildPipeline(path, jobId string, log Log) (Pipeline, error) {
 		return Pipeline{}, err
 	}
 
+	// Everything written to the log output file apart from the terminating
+	// line passes through the writer redacting the values of secrets
+	redact := newRedactWriter(outfile, nil)
+
 	var pipeline Pipeline
 	pipeline.File = outfile
+	pipeline.Output = newSyncWriter(redact)
 	pipeline.Log = log
-	for _, executable := range job.Pipeline {
-		cmd, execErr := buildExecutable(path, executable, setup.Machines, log, outfile)
-		if execErr != nil {
-			return Pipeline{}, execErr
+	pipeline.Timeout, _ = parseDuration(job.Timeout)
+	pipeline.Locks = job.Locks
+	pipeline.LockTimeout, _ = parseDuration(job.LockTimeout)
+
+	pipeline.builder = stepBuilder{
+		path:    path,
+		job:     job,
+		setup:   setup,
+		log:     log,
+		secrets: secrets,
+		redact:  redact,
+		output:  pipeline.Output,
+	}
+
+	// Jobs with a matrix run the steps of the job once for each variant
+	if job.Matrix != nil {
+		for i, values := range job.Matrix.expand() {
+			variant, err := pipeline.buildVariant(i, values)
+			if err != nil {
+				outfile.Close()
+				return Pipeline{}, err
+			}
+			pipeline.Variants = append(pipeline.Variants, variant)
+			pipeline.Log.Variants = append(pipeline.Log.Variants, variant.Log)
 		}
-		pipeline.Cmds = append(pipeline.Cmds, cmd)
+	} else {
+		pipeline.Steps, pipeline.Log.Steps, err = pipeline.builder.buildSteps()
+		if err != nil {
+			outfile.Close()
+			return Pipeline{}, err
+		}
+		pipeline.Log.OnFailure = handlerLogs(job.OnFailure, log.Parameters)
+		pipeline.Log.Finally = handlerLogs(job.Finally, log.Parameters)
 	}
 
+	redact.setSecrets(secrets.revealedValues())
 	return pipeline, nil
 }
 
+/*
+Type defining everything needed to build the steps of a job. The extra built-in
+environment variables are passed to every step
+*/
+type stepBuilder struct {
+	path    string
+	job     Job
+	setup   Setup
+	log     Log
+	secrets *Secrets
+	redact  *RedactWriter
+	output  *SyncWriter
+	extra   map[string]string
+}
+
+/*
+Build the steps of the pipeline of the job along with their logs. The handlers
+of the job are built once the pipeline has run, as the step that failed is
+passed to them
+*/
+func (b stepBuilder) buildSteps() ([]Step, []StepLog, error) {
+	var steps []Step
+	var logs []StepLog
+
+	// Jobs without any dependencies declared run their steps sequentially,
+	// writing directly to the log output. Otherwise the lines written
+	// by each step are prefixed by the step id
+	dag := isDAG(b.job)
+	for i, executable := range b.job.Pipeline {
+		prefix := ""
+		if dag {
+			prefix = "[" + stepId(i, executable) + "] "
+		}
+		step, stepLog, err := b.build(i, executable, prefix, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !dag && i > 0 {
+			step.Needs = []string{stepId(i-1, b.job.Pipeline[i-1])}
+		}
+		steps = append(steps, step)
+		logs = append(logs, stepLog)
+	}
+	return steps, logs, nil
+}
+
+/*
+Build the step running the executable at the given index of a list of steps,
+along with its log. The lines written by the step are prefixed by the given
+prefix, if any, and the extra built-in environment variables are passed to it
+*/
+func (b stepBuilder) build(index int, executable Executable, prefix string, extra map[string]string) (Step, StepLog, error) {
+	if len(b.extra) > 0 {
+		merged := map[string]string{}
+		for name, value := range b.extra {
+			merged[name] = value
+		}
+		for name, value := range extra {
+			merged[name] = value
+		}
+		extra = merged
+	}
+
+	// The parameters of the job are substituted into the arguments of
+	// the steps, and passed to them as environment variables
+	executable.Args = substituteParameters(executable.Args, b.log.Parameters)
+	step := Step{Id: stepId(index, executable), Index: index, Needs: executable.Needs}
+	step.When = newCondition(b.job, executable)
+	step.Timeout, _ = parseDuration(executable.Timeout)
+	step.Retry.Retries = executable.Retries
+	step.Retry.Delay, _ = parseDuration(executable.RetryDelay)
+	step.Retry.Exponential = executable.ExponentialBackoff
+	stepLog := newStepLog(step.Id, executable)
+
+	var out io.Writer = b.output
+	if prefix != "" {
+		step.Prefix = newPrefixWriter(prefix, b.output)
+		out = step.Prefix
+	}
+	step.Out = out
+	step.Redact = b.redact
+
+	// Steps targeting a group or tag run on each of its machines, with
+	// the lines written by each machine prefixed by the machine id
+	if isFanOut(executable.Machine) {
+		fanOut, err := buildFanOut(b.path, b.job, index, executable, b.setup, b.log, b.secrets, extra, prefix, b.output)
+		if err != nil {
+			return Step{}, StepLog{}, err
+		}
+		fanOut.Out = out
+		for _, command := range fanOut.Commands {
+			stepLog.Machines = append(stepLog.Machines, MachineLog{Machine: command.Machine, Status: "Pending"})
+		}
+		step.Cmd = fanOut
+		return step, stepLog, nil
+	}
+
+	env, err := stepEnv(b.job, index, executable, b.setup.Machines, b.log, b.secrets, extra)
+	if err != nil {
+		return Step{}, StepLog{}, err
+	}
+	step.Cmd, err = buildExecutable(b.path, executable, b.setup.Machines, env, out)
+	if err != nil {
+		return Step{}, StepLog{}, err
+	}
+	return step, stepLog, nil
+}
+
+/*
+Check whether any step of the job declares the steps it needs, making the
+pipeline of the job a graph rather than a sequence
+*/
+func isDAG(job Job) bool {
+	for _, executable := range job.Pipeline {
+		if len(executable.Needs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Get the id of the step at the given index of a pipeline, defaulting to the
+index if the executable has no id
+*/
+func stepId(i int, executable Executable) string {
+	if executable.Id != "" {
+		return executable.Id
+	}
+	return strconv.Itoa(i)
+}
+
+/*
+Parse a duration such as a timeout as given in the job configuration. An empty
+duration is returned as zero
+*/
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, errors.New("Duration must be positive")
+	}
+	return duration, nil
+}
+
 /*
 Build a command executable by the OS from an executable as defined in the job
-configuration
+configuration, passing the given environment variables to it
 */
-func buildExecutable(path string, executable Executable, machines []Machine, log Log, file *os.File) (*exec.Cmd, error) {
-	var cmd *exec.Cmd
+func buildExecutable(path string, executable Executable, machines []Machine, env []string, out io.Writer) (Command, error) {
 	script := path + "/scripts/" + executable.Script
-	scriptWithArgs := append([]string{script}, executable.Args...)
-	//script, executable.Args...
 	if executable.Machine == "local" {
-		cmd = exec.Command("/bin/bash", scriptWithArgs...)
-	} else {
-		var machine Machine
-		for _, m := range machines {
-			if m.Id == executable.Machine {
-				machine = m
-				break
-			}
+		cmd := LocalScript{
+			Script: script,
+			Args:   executable.Args,
+			Env:    env,
+			Stdout: out,
+			Stderr: out,
+		}
+		return cmd, nil
+	}
+
+	var machine Machine
+	found := false
+	for _, m := range machines {
+		if m.Id == executable.Machine {
+			machine = m
+			found = true
+			break
 		}
+	}
 
-		sshCommand := fmt.Sprintf(
-			"ssh -t -o 'StrictHostKeyChecking no' %s@%s -p %s -i %s 'bash -s' -- < %s %s",
-			machine.User,
-			machine.Address,
-			machine.Port,
-			path+"/keys/"+machine.PrivateKey,
-			script,
-			strings.Join(executable.Args, " "),
-		)
-		cmd = exec.Command("/bin/bash", "-c", sshCommand)
+	if !found {
+		return nil, errors.New("No machine with the given id was found")
 	}
 
-	cmd.Stdout = file
-	cmd.Stderr = file
+	executor, err := newSSHExecutor(path, machine)
+	if err != nil {
+		return nil, err
+	}
 
+	cmd := RemoteScript{
+		Executor: executor,
+		Script:   script,
+		Args:     executable.Args,
+		Env:      env,
+		Stdout:   out,
+		Stderr:   out,
+	}
 	return cmd, nil
 }
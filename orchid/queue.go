@@ -0,0 +1,72 @@
+/*
+Definition of and methods for the jobs queued to be run by the server, along
+with the limits on the number of concurrent jobs they are subject to
+*/
+
+package main
+
+import (
+	"github.com/yaccio/orchid/orchid/shared"
+	"sort"
+)
+
+/*
+The queued job type, which is shared with the server
+*/
+type QueuedJob = shared.QueuedJob
+
+/*
+Get the limits on the number of concurrent jobs the job is subject to, which
+are its own limit, the limits of the machines its steps and handlers run on,
+and its locks. A job holding a lock is the only job with the lock that is
+started, so workers are not kept busy waiting for the lock
+*/
+func jobLimits(setup Setup, job Job) map[string]int {
+	maxJobs := map[string]int{}
+	for _, machine := range setup.Machines {
+		maxJobs[machine.Id] = machine.MaxConcurrentJobs
+	}
+
+	limits := map[string]int{}
+	if job.MaxConcurrentJobs > 0 {
+		limits["job:"+job.Id] = job.MaxConcurrentJobs
+	}
+	steps := append(append(append([]Executable{}, job.Pipeline...), job.OnFailure...), job.Finally...)
+	for _, step := range steps {
+		for _, machine := range targetMachines(step.Machine, setup.Machines, setup.Groups) {
+			if max := maxJobs[machine]; max > 0 {
+				limits["machine:"+machine] = max
+			}
+		}
+	}
+	for _, lock := range job.Locks {
+		limits["lock:"+lock] = 1
+	}
+	return limits
+}
+
+/*
+Get the queued jobs in the order they were queued. Jobs no longer in the
+configuration are subject to no limits, and end with an error once started
+*/
+func queuedJobs(setup Setup, logs []Log) []QueuedJob {
+	queued := []Log{}
+	for _, log := range logs {
+		if log.Status == "Queued" {
+			queued = append(queued, log)
+		}
+	}
+	sort.SliceStable(queued, func(i, j int) bool {
+		return queued[i].QueueTime.Before(queued[j].QueueTime)
+	})
+
+	jobs := []QueuedJob{}
+	for _, log := range queued {
+		limits := map[string]int{}
+		if job, err := findJob(setup, log.JobId); err == nil {
+			limits = jobLimits(setup, job)
+		}
+		jobs = append(jobs, QueuedJob{LogId: log.Id, JobId: log.JobId, Limits: limits})
+	}
+	return jobs
+}
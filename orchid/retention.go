@@ -0,0 +1,137 @@
+/*
+Pruning of logs according to the retention policy of the setup
+*/
+
+package main
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+Prune the logs that are not to be kept according to the retention policy,
+deleting both the output and the metadata of each log. Logs of jobs that are
+still running are never pruned. If dry run is set, the logs are only returned
+and not deleted
+*/
+func pruneLogs(path string, dryRun bool) ([]Log, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := openLogStore(path)
+	logs, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	for _, log := range logs {
+		info, err := os.Stat(path + "/logs/" + log.Id)
+		if err == nil {
+			sizes[log.Id] = info.Size()
+		}
+	}
+
+	pruned := selectLogsToPrune(logs, sizes, config.Retention, time.Now())
+	if dryRun {
+		return pruned, nil
+	}
+
+	for _, log := range pruned {
+		err = os.Remove(path + "/logs/" + log.Id)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		err = store.Delete(log.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pruned, nil
+}
+
+/*
+Get the time the job of the log was run, which is the time it was queued if it
+never started, such as when it was cancelled while queued
+*/
+func runTime(log Log) time.Time {
+	if log.StartTime.IsZero() {
+		return log.QueueTime
+	}
+	return log.StartTime
+}
+
+/*
+Select the logs not to be kept according to the retention policy, given the
+size of the output of each log. Logs are selected if they are not among the
+most recent KeepRuns logs of their job, if they ended more than MaxAge ago, or
+if they are the oldest logs while the total size of all logs exceeds MaxSize
+*/
+func selectLogsToPrune(logs []Log, sizes map[string]int64, policy RetentionPolicy, now time.Time) []Log {
+	maxAge, _ := parseDuration(policy.MaxAge)
+	maxSize, _ := parseSize(policy.MaxSize)
+
+	// Only consider logs of jobs that are no longer running, oldest first
+	var candidates []Log
+	for _, log := range logs {
+		if log.Done() {
+			candidates = append(candidates, log)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return runTime(candidates[i]).Before(runTime(candidates[j]))
+	})
+
+	prune := map[string]bool{}
+
+	if policy.KeepRuns > 0 {
+		kept := map[string]int{}
+		for i := len(candidates) - 1; i >= 0; i-- {
+			log := candidates[i]
+			kept[log.JobId]++
+			if kept[log.JobId] > policy.KeepRuns {
+				prune[log.Id] = true
+			}
+		}
+	}
+
+	if maxAge > 0 {
+		for _, log := range candidates {
+			if now.Sub(log.EndTime) > maxAge {
+				prune[log.Id] = true
+			}
+		}
+	}
+
+	if maxSize > 0 {
+		var total int64
+		for _, log := range logs {
+			if !prune[log.Id] {
+				total += sizes[log.Id]
+			}
+		}
+		for _, log := range candidates {
+			if total <= maxSize {
+				break
+			}
+			if !prune[log.Id] {
+				prune[log.Id] = true
+				total -= sizes[log.Id]
+			}
+		}
+	}
+
+	var pruned []Log
+	for _, log := range candidates {
+		if prune[log.Id] {
+			pruned = append(pruned, log)
+		}
+	}
+	return pruned
+}
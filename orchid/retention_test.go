@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectLogsToPruneOrder(t *testing.T) {
+	now := time.Now()
+	logs := []Log{
+		{Id: "old", JobId: "j", Status: "Finished", StartTime: now.Add(-3 * time.Hour), EndTime: now.Add(-3 * time.Hour)},
+		{Id: "cancelled", JobId: "j", Status: "Cancelled", QueueTime: now.Add(-time.Hour), EndTime: now.Add(-time.Hour)},
+		{Id: "new", JobId: "j", Status: "Finished", StartTime: now.Add(-2 * time.Hour), EndTime: now.Add(-2 * time.Hour)},
+		{Id: "running", JobId: "j", Status: "Running", StartTime: now.Add(-4 * time.Hour)},
+	}
+
+	// A log cancelled while queued is as recent as the time it was queued
+	pruned := selectLogsToPrune(logs, nil, RetentionPolicy{KeepRuns: 2}, now)
+	if len(pruned) != 1 || pruned[0].Id != "old" {
+		t.Fatalf("Expected only the oldest log to be pruned, got %+v", pruned)
+	}
+
+	sizes := map[string]int64{"old": 10, "cancelled": 10, "new": 10, "running": 10}
+	pruned = selectLogsToPrune(logs, sizes, RetentionPolicy{MaxSize: "25"}, now)
+	if len(pruned) != 2 || pruned[0].Id != "old" || pruned[1].Id != "new" {
+		t.Fatalf("Expected the two oldest logs to be pruned, got %+v", pruned)
+	}
+}
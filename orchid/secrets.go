@@ -0,0 +1,365 @@
+/*
+Implementation of the encrypted secrets store. Each secret is encrypted with
+NaCl secretbox using the master key, which is read from the ORCHID_MASTER_KEY
+environment variable or the master.key file. The names of the secrets are
+stored in plain text, so they can be listed without the master key
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+The environment variable the master key can be given in, taking precedence
+over the master key file
+*/
+const masterKeyVariable = "ORCHID_MASTER_KEY"
+
+/*
+Prefix of the values of environment variables referring to a secret
+*/
+const secretPrefix = "secret:"
+
+/*
+The text secret values are replaced with in the log output
+*/
+const redacted = "********"
+
+/*
+Pattern matching a valid name of a secret
+*/
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+/*
+Type defining the secrets store. The master key is only read once a secret has
+to be encrypted or decrypted, and the values of the secrets decrypted are
+recorded so they can be redacted from the log output. Secrets may be decrypted
+concurrently by the variants of a job
+*/
+type Secrets struct {
+	mutex    sync.Mutex
+	path     string
+	key      *[32]byte
+	values   map[string]string
+	revealed []string
+}
+
+/*
+Type defining a writer redacting the values of secrets from everything written
+to it before passing it on. Output ending in what could be the start of a
+secret is held back until it is known not to be one, or the writer is flushed
+*/
+type RedactWriter struct {
+	mutex   sync.Mutex
+	out     io.Writer
+	secrets []string
+	buffer  []byte
+}
+
+/*
+Get the path of the master key file of the setup
+*/
+func masterKeyPath(path string) string {
+	return path + "/master.key"
+}
+
+/*
+Open the secrets store of the setup. The secrets file is created once a secret
+has been set
+*/
+func openSecrets(path string) (*Secrets, error) {
+	secrets := &Secrets{path: path, values: map[string]string{}}
+
+	data, err := ioutil.ReadFile(path + "/secrets")
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &secrets.values)
+	if err != nil {
+		return nil, errors.New("Secrets file invalid: " + err.Error())
+	}
+	return secrets, nil
+}
+
+/*
+Read the master key, which is base64 encoded. If no master key exists and
+create is true, a new master key is generated and written to the master key
+file
+*/
+func (s *Secrets) unlock(create bool) error {
+	if s.key != nil {
+		return nil
+	}
+
+	encoded := os.Getenv(masterKeyVariable)
+	if encoded == "" {
+		data, err := ioutil.ReadFile(masterKeyPath(s.path))
+		if os.IsNotExist(err) && create {
+			return s.createKey()
+		}
+		if os.IsNotExist(err) {
+			return errors.New("No master key found: Set " + masterKeyVariable + " or create " + masterKeyPath(s.path))
+		}
+		if err != nil {
+			return err
+		}
+		encoded = string(data)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(decoded) != 32 {
+		return errors.New("Master key invalid: Must be 32 bytes encoded as base64")
+	}
+
+	s.key = &[32]byte{}
+	copy(s.key[:], decoded)
+	return nil
+}
+
+/*
+Generate a new master key and write it to the master key file, which is only
+readable by its owner
+*/
+func (s *Secrets) createKey() error {
+	key := &[32]byte{}
+	_, err := io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(key[:]) + "\n"
+	err = ioutil.WriteFile(masterKeyPath(s.path), []byte(encoded), 0600)
+	if err != nil {
+		return err
+	}
+
+	s.key = key
+	return nil
+}
+
+/*
+Get the names of the secrets, sorted by name
+*/
+func (s *Secrets) Names() []string {
+	names := []string{}
+	for name := range s.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Decrypt the secret with the given name, recording its value for redaction
+*/
+func (s *Secrets) Get(name string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	encrypted, exists := s.values[name]
+	if !exists {
+		return "", errors.New("Secret not found: " + name)
+	}
+
+	err := s.unlock(false)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < 24 {
+		return "", errors.New("Secret invalid: " + name)
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], data[:24])
+	value, ok := secretbox.Open(nil, data[24:], &nonce, s.key)
+	if !ok {
+		return "", errors.New("Failed to decrypt secret " + name + ": Wrong master key")
+	}
+
+	s.revealed = append(s.revealed, string(value))
+	return string(value), nil
+}
+
+/*
+Get the values of the secrets decrypted so far
+*/
+func (s *Secrets) revealedValues() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.revealed...)
+}
+
+/*
+Encrypt the value and store it as the secret with the given name, replacing
+any secret with the same name
+*/
+func (s *Secrets) Set(name, value string) error {
+	if !secretName.MatchString(name) {
+		return errors.New("Invalid secret name '" + name + "': Must only contain letters, digits, '_', '.' and '-'")
+	}
+
+	err := s.unlock(true)
+	if err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	_, err = io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return err
+	}
+
+	encrypted := secretbox.Seal(nonce[:], []byte(value), &nonce, s.key)
+	s.values[name] = base64.StdEncoding.EncodeToString(encrypted)
+	return s.save()
+}
+
+/*
+Remove the secret with the given name
+*/
+func (s *Secrets) Remove(name string) error {
+	if _, exists := s.values[name]; !exists {
+		return errors.New("Secret not found: " + name)
+	}
+
+	delete(s.values, name)
+	return s.save()
+}
+
+/*
+Write the secrets to a temporary file which is renamed over the secrets file
+*/
+func (s *Secrets) save() error {
+	data, err := json.MarshalIndent(s.values, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file := s.path + "/secrets"
+	err = ioutil.WriteFile(file+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+/*
+Get the name of the secret referred to by the value of an environment
+variable, if it refers to one
+*/
+func secretReference(value string) (string, bool) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(value, secretPrefix), true
+}
+
+/*
+Get the environment of Orchid without the master key, to be passed to scripts
+*/
+func scriptEnviron() []string {
+	env := []string{}
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, masterKeyVariable+"=") {
+			env = append(env, variable)
+		}
+	}
+	return env
+}
+
+/*
+Create a writer redacting the values of the given secrets
+*/
+func newRedactWriter(out io.Writer, secrets []string) *RedactWriter {
+	w := &RedactWriter{out: out}
+	w.setSecrets(secrets)
+	return w
+}
+
+/*
+Set the values of the secrets to redact. Empty values are ignored, and longer
+values are redacted first so secrets containing other secrets are redacted
+completely
+*/
+func (w *RedactWriter) setSecrets(secrets []string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.secrets = []string{}
+	for _, secret := range secrets {
+		if secret != "" {
+			w.secrets = append(w.secrets, secret)
+		}
+	}
+	sort.Slice(w.secrets, func(i, j int) bool {
+		return len(w.secrets[i]) > len(w.secrets[j])
+	})
+}
+
+/*
+Write to the underlying writer with the values of the secrets redacted
+*/
+func (w *RedactWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buffer = append(w.buffer, data...)
+	for _, secret := range w.secrets {
+		w.buffer = bytes.Replace(w.buffer, []byte(secret), []byte(redacted), -1)
+	}
+
+	// Hold back the longest end of the output that is the start of a
+	// secret, as the rest of the secret may still be written
+	held := 0
+	for _, secret := range w.secrets {
+		for n := len(secret) - 1; n > held; n-- {
+			if bytes.HasSuffix(w.buffer, []byte(secret[:n])) {
+				held = n
+				break
+			}
+		}
+	}
+
+	_, err := w.out.Write(w.buffer[:len(w.buffer)-held])
+	w.buffer = append([]byte{}, w.buffer[len(w.buffer)-held:]...)
+	if err != nil {
+		return len(data), err
+	}
+	return len(data), nil
+}
+
+/*
+Write any output held back by the writer
+*/
+func (w *RedactWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.buffer) == 0 {
+		return nil
+	}
+
+	_, err := w.out.Write(w.buffer)
+	w.buffer = nil
+	return err
+}
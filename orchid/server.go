@@ -6,53 +6,48 @@ configuration files
 package main
 
 import (
-	"encoding/json"
-	"errors"
-	"io/ioutil"
+	"strconv"
 )
 
 /*
-Type defining the remote server setup configuration
+Type defining the remote server setup configuration. The number of workers is
+only used by the server itself
 */
 type Server struct {
 	Address string
 	Port    string
 	Secret  string
+	Workers int
 }
 
 /*
 Load the remote server configuration
 */
 func loadServer(path string) (Server, error) {
-	server := &Server{}
-	data, err := ioutil.ReadFile(path + "/server.json")
-	if err != nil {
-		return Server{}, err
+	v := newValidator(path)
+	server := Server{}
+	if v.load(serverFile, &server, false) {
+		validateServer(v, server)
 	}
 
-	err = json.Unmarshal(data, &server)
+	err := v.err()
 	if err != nil {
 		return Server{}, err
 	}
-
-	err = validateServer(*server)
-	if err != nil {
-		return Server{}, err
-	}
-
-	return *server, nil
+	return server, nil
 }
 
 /*
 Validate the remote server configuration
 */
-func validateServer(server Server) error {
+func validateServer(v *Validator, server Server) {
 	if server.Address == "" {
-		return errors.New("Server config invalid: Server must have a non-empty Address")
+		v.report(serverFile, "Address", "", "Server must have a non-empty Address")
 	}
 	if server.Port == "" {
-		return errors.New("Server config invalid: Server must have a non-empty Port")
+		v.report(serverFile, "Port", "", "Server must have a non-empty Port")
+	}
+	if server.Workers < 0 {
+		v.report(serverFile, "Workers", strconv.Itoa(server.Workers), "Server must not have a negative number of Workers")
 	}
-
-	return nil
 }
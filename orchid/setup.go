@@ -6,11 +6,24 @@ concerned with jobs, machines, and scripts
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+)
+
+/*
+The names of the configuration files of the setup
+*/
+const (
+	machinesFile = "machines.json"
+	groupsFile   = "groups.json"
+	jobsFile     = "jobs.json"
+	actionsFile  = "actions.json"
+	triggersFile = "triggers.json"
+	webhooksFile = "webhooks.json"
+	serverFile   = "server.json"
+	configFile   = "config.json"
 )
 
 /*
@@ -18,153 +31,141 @@ Type defining the complete setup of jobs, machines, and scripts
 */
 type Setup struct {
 	Machines []Machine
+	Groups   []Group
 	Jobs     []Job
 	Actions  []Action
 	Scripts  []string
+	Triggers []Trigger
 }
 
 /*
 Type defining a machine configuration
 */
 type Machine struct {
-	Id         string
-	Address    string
-	Port       string
-	User       string
-	PrivateKey string
+	Id                string
+	Address           string
+	Port              string
+	User              string
+	PrivateKey        string
+	HostKey           string
+	MaxConcurrentJobs int
+	Tags              []string
+	Env               map[string]string
 }
 
 /*
 Type defining a job configuration
 */
 type Job struct {
-	Id       string
-	Pipeline []Executable
+	Id                string
+	Timeout           string
+	MaxConcurrentJobs int
+	Locks             []string
+	LockTimeout       string
+	Parameters        []Parameter
+	Env               map[string]string
+	Pipeline          []Executable
+	OnFailure         []Executable
+	Finally           []Executable
+	Matrix            *Matrix
 }
 
 /*
 Type defining an executable (part of a job)
 */
 type Executable struct {
-	Machine string
-	Script  string
-	Args    []string
+	Id                 string
+	Needs              []string
+	When               string
+	Machine            string
+	MaxParallel        int
+	Strategy           *Strategy
+	Script             string
+	Args               []string
+	Timeout            string
+	Retries            int
+	RetryDelay         string
+	ExponentialBackoff bool
+	Env                map[string]string
 }
 
 /*
 Type defining an action
 */
 type Action struct {
-	Id      string
-	Machine string
-	Command string
+	Id          string
+	Machine     string
+	MaxParallel int
+	Command     string
 }
 
 /*
-Load the configuration files concerned with the setup
+Load the configuration files concerned with the setup, failing with every
+problem found in them
 */
 func loadSetup(path string) (Setup, error) {
-	machines, machineErr := loadMachines(path)
-	if machineErr != nil {
-		return Setup{}, machineErr
+	v := newValidator(path)
+	setup := validateSetup(v)
+	err := v.err()
+	if err != nil {
+		return Setup{}, err
 	}
+	return setup, nil
+}
 
-	jobs, jobErr := loadJobs(path)
-	if jobErr != nil {
-		return Setup{}, jobErr
-	}
+/*
+Load and validate the configuration files concerned with the setup, reporting
+every problem found to the validator
+*/
+func validateSetup(v *Validator) Setup {
+	machines := []Machine{}
+	v.load(machinesFile, &machines, false)
 
-	actions, actionErr := loadActions(path)
-	if actionErr != nil {
-		return Setup{}, actionErr
-	}
+	groups := []Group{}
+	v.load(groupsFile, &groups, true)
 
-	scripts, scriptErr := loadDir(path + "/scripts")
-	if scriptErr != nil {
-		return Setup{}, scriptErr
-	}
+	jobs := []Job{}
+	v.load(jobsFile, &jobs, false)
 
-	keys, keyErr := loadDir(path + "/keys")
-	if keyErr != nil {
-		return Setup{}, keyErr
-	}
+	actions := []Action{}
+	v.load(actionsFile, &actions, false)
 
-	machineValidationErr := validateMachines(machines, keys, path)
-	if machineValidationErr != nil {
-		return Setup{}, machineValidationErr
-	}
+	triggers := []Trigger{}
+	v.load(triggersFile, &triggers, true)
 
-	jobValidationErr := validateJobs(jobs, machines, scripts, path)
-	if jobValidationErr != nil {
-		return Setup{}, jobValidationErr
-	}
+	webhooks := []Webhook{}
+	v.load(webhooksFile, &webhooks, true)
 
-	actionValidationErr := validateActions(actions, machines)
-	if actionValidationErr != nil {
-		return Setup{}, actionValidationErr
-	}
+	scripts, _ := loadDir(v.path + "/scripts")
+	keys, _ := loadDir(v.path + "/keys")
 
-	setup := Setup{
+	validateMachines(v, machines, relativePaths(v.path+"/keys", keys))
+	validateGroups(v, groups, machines)
+	validateJobs(v, jobs, machines, groups, relativePaths(v.path+"/scripts", scripts))
+	validateActions(v, actions, machines, groups)
+	validateTriggers(v, triggers, jobs, actions)
+	triggers = append(triggers, validateWebhooks(v, webhooks, jobs)...)
+
+	return Setup{
 		Machines: machines,
+		Groups:   groups,
 		Jobs:     jobs,
 		Actions:  actions,
 		Scripts:  scripts,
+		Triggers: triggers,
 	}
-	return setup, nil
-}
-
-/*
-Load the configuration files concerned with machines
-*/
-func loadMachines(path string) ([]Machine, error) {
-	machines := &[]Machine{}
-	data, err := ioutil.ReadFile(path + "/machines.json")
-	if err != nil {
-		return []Machine{}, err
-	}
-
-	err = json.Unmarshal(data, &machines)
-	if err != nil {
-		return []Machine{}, err
-	}
-
-	return *machines, nil
 }
 
 /*
-Load the configuration files concerned with jobs
+Find the job with the given id in the setup
 */
-func loadJobs(path string) ([]Job, error) {
-	jobs := &[]Job{}
-	data, err := ioutil.ReadFile(path + "/jobs.json")
-	if err != nil {
-		return []Job{}, err
-	}
-
-	err = json.Unmarshal(data, &jobs)
-	if err != nil {
-		return []Job{}, err
-	}
-
-	return *jobs, nil
-}
-
-/*
-Load the configuration files concerned with actions
-*/
-func loadActions(path string) ([]Action, error) {
-	actions := &[]Action{}
-	data, err := ioutil.ReadFile(path + "/actions.json")
-	if err != nil {
-		return []Action{}, err
-	}
-
-	err = json.Unmarshal(data, &actions)
-	if err != nil {
-		return []Action{}, err
+func findJob(setup Setup, jobId string) (Job, error) {
+	for _, job := range setup.Jobs {
+		if job.Id == jobId {
+			return job, nil
+		}
 	}
-
-	return *actions, nil
+	return Job{}, errors.New("Job not found")
 }
 
 /*
@@ -189,104 +190,255 @@ func loadDir(path string) ([]string, error) {
 }
 
 /*
-Validate the machine configuration
+Get the paths of files relative to the directory they were loaded from
 */
-func validateMachines(machines []Machine, keys []string, path string) error {
+func relativePaths(dir string, files []string) []string {
+	relative := []string{}
+	for _, file := range files {
+		relative = append(relative, file[len(dir)+1:])
+	}
+	return relative
+}
 
+/*
+Get the ids of the machines a step or action may run on, including the local
+machine
+*/
+func machineIds(machines []Machine) []string {
+	ids := []string{"local"}
 	for _, machine := range machines {
+		ids = append(ids, machine.Id)
+	}
+	return ids
+}
+
+/*
+Validate the machine configuration
+*/
+func validateMachines(v *Validator, machines []Machine, keys []string) {
+	ids := map[string]bool{}
+	for i, machine := range machines {
+		at := indexPath("", i)
 		if machine.Id == "" {
-			return errors.New("Machine config invalid: Each machine must have a non-empty id")
+			v.report(machinesFile, fieldPath(at, "Id"), "", "Each machine must have a non-empty Id")
+		} else if machine.Id == "local" {
+			v.report(machinesFile, fieldPath(at, "Id"), machine.Id, "Machine id 'local' is reserved for the local machine")
+		} else if ids[machine.Id] {
+			v.report(machinesFile, fieldPath(at, "Id"), machine.Id, "Machine id '"+machine.Id+"' is already in use")
 		}
+		ids[machine.Id] = true
+
 		if machine.Address == "" {
-			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty Address")
+			v.report(machinesFile, fieldPath(at, "Address"), "", "Machine '"+machine.Id+"' must have a non-empty Address")
 		}
 		if machine.Port == "" {
-			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty Port")
+			v.report(machinesFile, fieldPath(at, "Port"), "", "Machine '"+machine.Id+"' must have a non-empty Port")
 		}
 		if machine.User == "" {
-			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty User")
+			v.report(machinesFile, fieldPath(at, "User"), "", "Machine '"+machine.Id+"' must have a non-empty User")
 		}
 		if machine.PrivateKey == "" {
-			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty PrivateKey")
+			v.report(machinesFile, fieldPath(at, "PrivateKey"), "", "Machine '"+machine.Id+"' must have a non-empty PrivateKey")
+		} else if !contains(keys, machine.PrivateKey) {
+			v.reportUnknown(machinesFile, fieldPath(at, "PrivateKey"), machine.PrivateKey, "Machine '"+machine.Id+"' contains reference to unknown PrivateKey '"+machine.PrivateKey+"'", keys)
 		}
 
-		pathLength := len(path + "/keys")
-		found := false
-		for _, key := range keys {
-			if machine.PrivateKey == key[pathLength+1:] {
-				found = true
-				break
-			}
+		if machine.HostKey != "" && validateHostKey(machine.HostKey) != nil {
+			v.report(machinesFile, fieldPath(at, "HostKey"), machine.HostKey, "Machine '"+machine.Id+"' must have a HostKey in authorized_keys format or a SHA256 fingerprint")
 		}
-		if !found {
-			return errors.New("Machine config invalid: Machine '" + machine.Id + "' contains reference to unknown PrivateKey")
+		if machine.MaxConcurrentJobs < 0 {
+			v.report(machinesFile, fieldPath(at, "MaxConcurrentJobs"), strconv.Itoa(machine.MaxConcurrentJobs), "Machine '"+machine.Id+"' must not have a negative MaxConcurrentJobs")
+		}
+		for j, tag := range machine.Tags {
+			if tag == "" {
+				v.report(machinesFile, indexPath(fieldPath(at, "Tags"), j), "", "Machine '"+machine.Id+"' must not have an empty tag")
+			}
 		}
+		validateEnv(v, machinesFile, fieldPath(at, "Env"), machine.Env, "Machine '"+machine.Id+"'")
 	}
-
-	return nil
 }
 
 /*
-Validate the job configuration
+Validate the job configuration. Steps may run on the local machine even if no
+machines are configured
 */
-func validateJobs(jobs []Job, machines []Machine, scripts []string, path string) error {
-	for _, job := range jobs {
+func validateJobs(v *Validator, jobs []Job, machines []Machine, groups []Group, scripts []string) {
+	ids := map[string]bool{}
+	for i, job := range jobs {
+		at := indexPath("", i)
 		if job.Id == "" {
-			return errors.New("Job config invalid: Each job must have a non-empty id")
+			v.report(jobsFile, fieldPath(at, "Id"), "", "Each job must have a non-empty Id")
+		} else if ids[job.Id] {
+			v.report(jobsFile, fieldPath(at, "Id"), job.Id, "Job id '"+job.Id+"' is already in use")
 		}
+		ids[job.Id] = true
+
 		if len(job.Pipeline) == 0 {
-			return errors.New("Job config invalid: Job '" + job.Id + "' must have a non-empty Pipeline")
+			v.report(jobsFile, fieldPath(at, "Pipeline"), "", "Job '"+job.Id+"' must have a non-empty Pipeline")
 		}
-
-		for _, executable := range job.Pipeline {
-			machineFound := false
-			for _, machine := range machines {
-				if executable.Machine == machine.Id || executable.Machine == "local" {
-					machineFound = true
-					break
-				}
-			}
-			if !machineFound {
-				return errors.New("Job config invalid: Job '" + job.Id + "' contains a reference to one or more unknown machines")
-			}
-
-			pathLength := len(path + "/scripts")
-			scriptFound := false
-			for _, script := range scripts {
-				if (executable.Script) == script[pathLength+1:] {
-					scriptFound = true
-					break
-				}
-			}
-			if !scriptFound {
-				return errors.New("Job config invalid: Job '" + job.Id + "' contains a reference to one or more unknown scripts")
+		if _, err := parseDuration(job.Timeout); err != nil {
+			v.report(jobsFile, fieldPath(at, "Timeout"), job.Timeout, "Job '"+job.Id+"' must have a Timeout that is a positive duration such as '30m', got '"+job.Timeout+"'")
+		}
+		if job.MaxConcurrentJobs < 0 {
+			v.report(jobsFile, fieldPath(at, "MaxConcurrentJobs"), strconv.Itoa(job.MaxConcurrentJobs), "Job '"+job.Id+"' must not have a negative MaxConcurrentJobs")
+		}
+		for j, lock := range job.Locks {
+			if !validLockName(lock) {
+				v.report(jobsFile, indexPath(fieldPath(at, "Locks"), j), lock, "Job '"+job.Id+"' contains invalid lock name '"+lock+"'")
 			}
 		}
+		if _, err := parseDuration(job.LockTimeout); err != nil {
+			v.report(jobsFile, fieldPath(at, "LockTimeout"), job.LockTimeout, "Job '"+job.Id+"' must have a LockTimeout that is a positive duration such as '10m', got '"+job.LockTimeout+"'")
+		}
+		validateParameters(v, at, job)
+		validateEnv(v, jobsFile, fieldPath(at, "Env"), job.Env, "Job '"+job.Id+"'")
+		validateMatrix(v, at, job)
+
+		for j, executable := range job.Pipeline {
+			stepAt := indexPath(fieldPath(at, "Pipeline"), j)
+			step := "Step '" + stepId(j, executable) + "' of job '" + job.Id + "'"
+			validateExecutable(v, stepAt, executable, step, machines, groups, scripts)
+			validateCondition(v, stepAt, job, executable, step, stepsBefore(job, j))
+		}
+		validateHandler(v, at, job, "OnFailure", job.OnFailure, machines, groups, scripts)
+		validateHandler(v, at, job, "Finally", job.Finally, machines, groups, scripts)
+
+		validateSteps(v, at, job)
+	}
+}
+
+/*
+Validate a step of a job at the given path, which is described by the given
+name for use in messages
+*/
+func validateExecutable(v *Validator, stepAt string, executable Executable, step string, machines []Machine, groups []Group, scripts []string) {
+	if _, err := parseDuration(executable.Timeout); err != nil {
+		v.report(jobsFile, fieldPath(stepAt, "Timeout"), executable.Timeout, step+" must have a Timeout that is a positive duration such as '30m', got '"+executable.Timeout+"'")
 	}
 
-	return nil
+	validateEnv(v, jobsFile, fieldPath(stepAt, "Env"), executable.Env, step)
+
+	if executable.Retries < 0 {
+		v.report(jobsFile, fieldPath(stepAt, "Retries"), strconv.Itoa(executable.Retries), step+" must not have a negative number of Retries")
+	}
+	if _, err := parseDuration(executable.RetryDelay); err != nil {
+		v.report(jobsFile, fieldPath(stepAt, "RetryDelay"), executable.RetryDelay, step+" must have a RetryDelay that is a positive duration such as '10s', got '"+executable.RetryDelay+"'")
+	}
+
+	validateTarget(v, jobsFile, stepAt, executable.Machine, executable.MaxParallel, step, machines, groups)
+	validateStrategy(v, stepAt, executable, step, scripts)
+	if executable.Script == "" {
+		v.report(jobsFile, fieldPath(stepAt, "Script"), "", step+" must have a non-empty Script")
+	} else if !contains(scripts, executable.Script) {
+		v.reportUnknown(jobsFile, fieldPath(stepAt, "Script"), executable.Script, step+" contains a reference to unknown script '"+executable.Script+"'", scripts)
+	}
 }
 
 /*
-Validate the action configuration
+Validate the steps of a handler of the job at the given path. Handler steps run
+one after the other, so they cannot need other steps, and run once every step
+of the pipeline has finished
 */
-func validateActions(actions []Action, machines []Machine) error {
-	for _, action := range actions {
-		if action.Id == "" {
-			return errors.New("Action config invalid: Each action must have a non-empty id")
+func validateHandler(v *Validator, at string, job Job, name string, executables []Executable, machines []Machine, groups []Group, scripts []string) {
+	pipeline := []string{}
+	for i, executable := range job.Pipeline {
+		pipeline = append(pipeline, stepId(i, executable))
+	}
+
+	ids := map[string]bool{}
+	for i, executable := range executables {
+		stepAt := indexPath(fieldPath(at, name), i)
+		step := name + " step '" + stepId(i, executable) + "' of job '" + job.Id + "'"
+		if ids[stepId(i, executable)] {
+			v.report(jobsFile, fieldPath(stepAt, "Id"), executable.Id, "Job '"+job.Id+"' contains more than one "+name+" step with the id '"+executable.Id+"'")
+		}
+		ids[stepId(i, executable)] = true
+
+		if len(executable.Needs) > 0 {
+			v.report(jobsFile, fieldPath(stepAt, "Needs"), "", step+" must not have Needs, as "+name+" steps run one after the other")
+		}
+		validateExecutable(v, stepAt, executable, step, machines, groups, scripts)
+		validateCondition(v, stepAt, job, executable, step, pipeline)
+	}
+}
+
+/*
+Validate the ids of the steps of the job at the given path and the dependencies
+between them, rejecting duplicate ids, references to unknown steps, and cycles
+*/
+func validateSteps(v *Validator, at string, job Job) {
+	steps := map[string]Executable{}
+	ids := []string{}
+	for i, executable := range job.Pipeline {
+		id := stepId(i, executable)
+		if _, exists := steps[id]; exists {
+			v.report(jobsFile, fieldPath(indexPath(fieldPath(at, "Pipeline"), i), "Id"), id, "Job '"+job.Id+"' contains more than one step with the id '"+id+"'")
 		}
+		steps[id] = executable
+		ids = append(ids, id)
+	}
 
-		machineFound := false
-		for _, machine := range machines {
-			if action.Machine == machine.Id || action.Machine == "local" {
-				machineFound = true
-				break
+	unknown := false
+	for i, executable := range job.Pipeline {
+		id := stepId(i, executable)
+		for j, need := range executable.Needs {
+			if _, exists := steps[need]; !exists {
+				unknown = true
+				v.reportUnknown(jobsFile, indexPath(fieldPath(indexPath(fieldPath(at, "Pipeline"), i), "Needs"), j), need, "Step '"+id+"' of job '"+job.Id+"' needs unknown step '"+need+"'", ids)
 			}
 		}
-		if !machineFound {
-			return errors.New("Action config invalid: Action '" + action.Id + "' contains a reference to one or more unknown machines")
+	}
+	if unknown {
+		return
+	}
+
+	// Depth first search for cycles, marking steps as visiting while their
+	// dependencies are searched, and as visited once they are done
+	const visiting, visited = 1, 2
+	state := map[string]int{}
+	var visit func(id string) bool
+	visit = func(id string) bool {
+		if state[id] == visiting {
+			return false
+		}
+		if state[id] == visited {
+			return true
 		}
+
+		state[id] = visiting
+		for _, need := range steps[id].Needs {
+			if !visit(need) {
+				return false
+			}
+		}
+		state[id] = visited
+		return true
 	}
 
-	return nil
+	for i, executable := range job.Pipeline {
+		id := stepId(i, executable)
+		if !visit(id) {
+			v.report(jobsFile, fieldPath(indexPath(fieldPath(at, "Pipeline"), i), "Needs"), id, "Job '"+job.Id+"' contains a cycle in the steps needed by step '"+id+"'")
+			return
+		}
+	}
+}
+
+/*
+Validate the action configuration. Actions may run on the local machine even
+if no machines are configured
+*/
+func validateActions(v *Validator, actions []Action, machines []Machine, groups []Group) {
+	ids := map[string]bool{}
+	for i, action := range actions {
+		at := indexPath("", i)
+		if action.Id == "" {
+			v.report(actionsFile, fieldPath(at, "Id"), "", "Each action must have a non-empty Id")
+		} else if ids[action.Id] {
+			v.report(actionsFile, fieldPath(at, "Id"), action.Id, "Action id '"+action.Id+"' is already in use")
+		}
+		ids[action.Id] = true
+
+		validateTarget(v, actionsFile, at, action.Machine, action.MaxParallel, "Action '"+action.Id+"'", machines, groups)
+	}
 }
@@ -0,0 +1,127 @@
+/*
+Definition of logs and the events causing jobs to run. The command line
+interface stores and lists logs, and the server reads the logs listed and
+passes the events to the command line interface, so both share these types
+*/
+
+package shared
+
+import (
+	"time"
+)
+
+/*
+Definition of the log type. The log of a job with a matrix holds a log for each
+variant of the matrix instead of logs of its steps, identified by the values of
+the axes of the variant
+*/
+type Log struct {
+	Id         string
+	JobId      string
+	Status     string
+	QueueTime  time.Time
+	StartTime  time.Time
+	EndTime    time.Time
+	Parameters map[string]string `json:",omitempty"`
+	Event      *Event            `json:",omitempty"`
+	Steps      []StepLog
+	OnFailure  []StepLog `json:",omitempty"`
+	Finally    []StepLog `json:",omitempty"`
+	Variants   []Log     `json:",omitempty"`
+}
+
+/*
+Definition of the event that caused the server to run a job. The fields given
+depend on the type of the event, which is one of "push", "pull_request",
+"schedule", "after" and "watch"
+*/
+type Event struct {
+	Type       string
+	Repository string `json:",omitempty"`
+	Ref        string `json:",omitempty"`
+	Branch     string `json:",omitempty"`
+	Commit     string `json:",omitempty"`
+	Schedule   string `json:",omitempty"`
+	JobId      string `json:",omitempty"`
+	LogId      string `json:",omitempty"`
+	Status     string `json:",omitempty"`
+	Path       string `json:",omitempty"`
+}
+
+/*
+Describe the event in a single line
+*/
+func (e Event) String() string {
+	switch e.Type {
+	case "push", "pull_request":
+		return e.Type + " " + e.Repository + " " + e.Ref + " (" + e.Commit + ")"
+	case "schedule":
+		return e.Type + " " + e.Schedule
+	case "after":
+		return e.Type + " " + e.JobId + " " + e.LogId + " (" + e.Status + ")"
+	case "watch":
+		return e.Type + " " + e.Path
+	}
+	return e.Type
+}
+
+/*
+Definition of the log of a single step of a job. The exit code is -1 if the
+step did not exit normally. Steps targeting a group or tag have the results of
+each of the machines they ran on, and the machines touched by any attempt, in
+the order they were started
+*/
+type StepLog struct {
+	Id        string
+	Machine   string
+	Script    string
+	Args      []string
+	ExitCode  int
+	Attempts  int
+	Status    string
+	StartTime time.Time
+	EndTime   time.Time
+	Machines  []MachineLog `json:",omitempty"`
+	Touched   []string     `json:",omitempty"`
+}
+
+/*
+Definition of the result of a step on a single machine of a group or tag
+*/
+type MachineLog struct {
+	Machine   string
+	ExitCode  int
+	Status    string
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+/*
+Check whether the job of the log is no longer running
+*/
+func (l Log) Done() bool {
+	switch l.Status {
+	case "Finished", "Error", "TimedOut", "Cancelled":
+		return true
+	}
+	return false
+}
+
+/*
+Get the ids of the steps of the log that failed. Steps of variants are prefixed
+by the id of the variant
+*/
+func (l Log) FailedSteps() []string {
+	var failed []string
+	for _, step := range l.Steps {
+		if step.Status == "Failed" {
+			failed = append(failed, step.Id)
+		}
+	}
+	for _, variant := range l.Variants {
+		for _, step := range variant.FailedSteps() {
+			failed = append(failed, "["+variant.Id+"] "+step)
+		}
+	}
+	return failed
+}
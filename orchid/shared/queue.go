@@ -0,0 +1,18 @@
+/*
+Definition of the jobs queued to be run by the server. The command line
+interface lists the queued jobs along with the limits they are subject to, and
+the server runs them while respecting these limits
+*/
+
+package shared
+
+/*
+Type defining a queued job, along with the limits on the number of concurrent
+jobs it is subject to. The limits are keyed by "job:<id>", "machine:<id>" and
+"lock:<name>"
+*/
+type QueuedJob struct {
+	LogId  string
+	JobId  string
+	Limits map[string]int
+}
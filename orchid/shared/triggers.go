@@ -0,0 +1,148 @@
+/*
+Definition of the triggers, which map events to the jobs the server runs when
+they occur. The command line interface validates and lists the triggers, and
+the server evaluates them
+*/
+
+package shared
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+Type defining a trigger running a job when an event occurs. Exactly one source
+of events must be given. The parameters are passed to the job when it is run.
+Schedule triggers may run an action instead of a job
+*/
+type Trigger struct {
+	Job        string            `json:",omitempty"`
+	Action     string            `json:",omitempty"`
+	Parameters map[string]string `json:",omitempty"`
+	Webhook    *WebhookTrigger   `json:",omitempty"`
+	Schedule   *ScheduleTrigger  `json:",omitempty"`
+	After      *AfterTrigger     `json:",omitempty"`
+	Watch      *WatchTrigger     `json:",omitempty"`
+}
+
+/*
+Type defining webhooks received by the server triggering a job. Empty fields
+match anything
+*/
+type WebhookTrigger struct {
+	Repository string
+	Event      string
+	Branch     string
+}
+
+/*
+Type defining a schedule triggering a job, as a standard 5-field cron
+expression evaluated in the given timezone. Missed defines whether a run missed
+while the server was not running is skipped or caught up when it starts
+*/
+type ScheduleTrigger struct {
+	Cron     string
+	Timezone string `json:",omitempty"`
+	Missed   string `json:",omitempty"`
+}
+
+/*
+Type defining the completion of another job triggering a job. An empty status
+matches any completion
+*/
+type AfterTrigger struct {
+	Job    string
+	Status string
+}
+
+/*
+Type defining changes to the files in a directory triggering a job. An empty
+pattern matches any file
+*/
+type WatchTrigger struct {
+	Directory string
+	Pattern   string
+}
+
+/*
+Describe what the trigger runs, for use in messages
+*/
+func (t Trigger) Target() string {
+	if t.Action != "" {
+		return "action '" + t.Action + "'"
+	}
+	return "job '" + t.Job + "'"
+}
+
+/*
+Get the key identifying a schedule trigger in the schedule state kept by the
+server
+*/
+func (t Trigger) ScheduleKey() string {
+	return t.Job + "|" + t.Action + "|" + t.Schedule.Cron + "|" + t.Schedule.Timezone
+}
+
+/*
+Get the location the cron expression of the schedule is interpreted in, which
+is the local timezone of the server if no timezone is given
+*/
+func (s ScheduleTrigger) Location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+/*
+Check whether an event matches the webhook trigger. Empty fields match anything
+*/
+func (webhook WebhookTrigger) Matches(event Event) bool {
+	if webhook.Repository != "" && webhook.Repository != event.Repository {
+		return false
+	}
+	if webhook.Event != "" && webhook.Event != event.Type {
+		return false
+	}
+	if webhook.Branch != "" {
+		pattern, err := BranchPattern(webhook.Branch)
+		return err == nil && pattern.MatchString(event.Branch)
+	}
+	return true
+}
+
+/*
+Compile a pattern a branch must match into a regular expression. As with
+path.Match, * matches any sequence of characters other than /, ? matches any
+single character other than /, and [...] matches a class of characters, while
+** matches any sequence of characters including /, such as in release/**
+*/
+func BranchPattern(pattern string) (*regexp.Regexp, error) {
+	expression := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression += ".*"
+			i++
+		case c == '*':
+			expression += "[^/]*"
+		case c == '?':
+			expression += "[^/]"
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("Unterminated character class in '" + pattern + "'")
+			}
+			expression += pattern[i : i+end+1]
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			expression += regexp.QuoteMeta(pattern[i+1 : i+2])
+			i++
+		default:
+			expression += regexp.QuoteMeta(string(c))
+		}
+	}
+	return regexp.Compile(expression + "$")
+}
@@ -0,0 +1,247 @@
+/*
+Native SSH client used for executing scripts and commands on remote machines
+without depending on the ssh binary being installed
+*/
+
+package main
+
+import (
+	"context"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+Type defining an executor running commands on a single remote machine
+*/
+type SSHExecutor struct {
+	Machine Machine
+	Config  *ssh.ClientConfig
+}
+
+/*
+Type defining a script executed on a remote machine. The script is streamed to
+a remote shell on stdin, making quoting of the script itself unnecessary
+*/
+type RemoteScript struct {
+	Executor SSHExecutor
+	Script   string
+	Args     []string
+	Env      []string
+	Stdout   io.Writer
+	Stderr   io.Writer
+}
+
+/*
+Type defining a command run on a remote machine without a terminal attached
+*/
+type RemoteCommand struct {
+	Executor SSHExecutor
+	Command  string
+	Stdout   io.Writer
+	Stderr   io.Writer
+}
+
+/*
+Create an executor for the given machine, loading its private key from the keys
+directory
+*/
+func newSSHExecutor(path string, machine Machine) (SSHExecutor, error) {
+	data, err := ioutil.ReadFile(path + "/keys/" + machine.PrivateKey)
+	if err != nil {
+		return SSHExecutor{}, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return SSHExecutor{}, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:            machine.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback(path, machine),
+		Timeout:         30 * time.Second,
+	}
+
+	return SSHExecutor{Machine: machine, Config: config}, nil
+}
+
+/*
+Open a connection to the machine of the executor
+*/
+func (e SSHExecutor) dial() (*ssh.Client, error) {
+	address := net.JoinHostPort(e.Machine.Address, e.Machine.Port)
+	return ssh.Dial("tcp", address, e.Config)
+}
+
+/*
+Run a command on the machine, connecting the given streams to the remote
+command. The returned error is an *ssh.ExitError if the command ran but exited
+with a non-zero status. If the context is cancelled before the command has
+finished, the remote command is killed and the connection closed
+*/
+func (e SSHExecutor) Run(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	client, err := e.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	err = session.Run(command)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+/*
+Run a command on the machine attached to the local terminal. If the command is
+empty, an interactive login shell is started instead
+*/
+func (e SSHExecutor) Interactive(command string) error {
+	client, err := e.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	// Request a pseudo terminal if running in one, putting the local
+	// terminal in raw mode for the duration of the session
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm"
+		}
+
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		err = session.RequestPty(termType, height, width, modes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if command == "" {
+		err = session.Shell()
+		if err != nil {
+			return err
+		}
+		return session.Wait()
+	}
+
+	return session.Run(command)
+}
+
+/*
+Run the script on the remote machine, streaming it to bash on stdin preceded by
+the environment variables of the script
+*/
+func (r RemoteScript) Run(ctx context.Context) error {
+	file, err := os.Open(r.Script)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The environment variables are exported by lines streamed ahead of the
+	// script, as servers commonly refuse environment variables sent through
+	// the session, and values on the command line, such as secrets, would be
+	// visible to every user of the remote machine
+	exports := ""
+	for _, variable := range r.Env {
+		parts := strings.SplitN(variable, "=", 2)
+		exports += "export " + parts[0] + "=" + shellQuote(parts[1]) + "\n"
+	}
+	command := "bash -s --"
+	for _, arg := range r.Args {
+		command += " " + shellQuote(arg)
+	}
+
+	return r.Executor.Run(ctx, command, io.MultiReader(strings.NewReader(exports), file), r.Stdout, r.Stderr)
+}
+
+/*
+Run the command on the remote machine
+*/
+func (r RemoteCommand) Run(ctx context.Context) error {
+	return r.Executor.Run(ctx, r.Command, nil, r.Stdout, r.Stderr)
+}
+
+/*
+Quote a string for safe use as a single argument in a remote shell command
+*/
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+/*
+Get the exit status of a command from the error returned when running it
+locally or remotely. Returns -1 if the command did not exit normally
+*/
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+Start an SSH server on a random local port, accepting only the given public
+key and running the commands of exec requests with bash. A signal request kills
+the running command along with its children. The server is stopped when the
+test ends
+*/
+func startSSHServer(t *testing.T, authorized ssh.PublicKey) net.Listener {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("Key not authorized")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return listener
+}
+
+/*
+Serve the sessions of a single connection to the test SSH server
+*/
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			var cmd *exec.Cmd
+			for request := range requests {
+				switch request.Type {
+				case "exec":
+					var payload struct{ Command string }
+					ssh.Unmarshal(request.Payload, &payload)
+					cmd = exec.Command("/bin/bash", "-c", payload.Command)
+					cmd.Stdin = channel
+					cmd.Stdout = channel
+					cmd.Stderr = channel.Stderr()
+					cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+					if err := cmd.Start(); err != nil {
+						request.Reply(false, nil)
+						continue
+					}
+					request.Reply(true, nil)
+
+					go func(cmd *exec.Cmd) {
+						status := make([]byte, 4)
+						binary.BigEndian.PutUint32(status, uint32(exitStatus(cmd.Wait())))
+						channel.SendRequest("exit-status", false, status)
+						channel.Close()
+					}(cmd)
+				case "signal":
+					if cmd != nil {
+						syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+					}
+					request.Reply(true, nil)
+				default:
+					request.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+/*
+Create a setup directory with a private key for the test machine, returning the
+directory and the public key of the machine
+*/
+func setupSSHKeys(t *testing.T) (string, ssh.PublicKey) {
+	dir := t.TempDir()
+	for _, sub := range []string{"keys", "scripts", "logs"} {
+		if err := os.MkdirAll(dir+"/"+sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/keys/m.key", pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, key
+}
+
+/*
+Get the machine connecting to the test SSH server with the key of the setup
+*/
+func testMachine(t *testing.T, listener net.Listener) Machine {
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Machine{Id: "m", Address: host, Port: port, User: "orchid", PrivateKey: "m.key"}
+}
+
+/*
+Run a script on the machine, returning its output and error
+*/
+func runRemoteScript(t *testing.T, ctx context.Context, dir string, machine Machine, script string, args []string, env []string) (string, error) {
+	if err := ioutil.WriteFile(dir+"/scripts/s.sh", []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	executor, err := newSSHExecutor(dir, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output strings.Builder
+	err = RemoteScript{
+		Executor: executor,
+		Script:   dir + "/scripts/s.sh",
+		Args:     args,
+		Env:      env,
+		Stdout:   &output,
+		Stderr:   &output,
+	}.Run(ctx)
+	return output.String(), err
+}
+
+func TestRemoteScriptRequiresTrustedHost(t *testing.T) {
+	dir, key := setupSSHKeys(t)
+	machine := testMachine(t, startSSHServer(t, key))
+
+	_, err := runRemoteScript(t, context.Background(), dir, machine, "echo ok\n", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "is not trusted") {
+		t.Fatalf("Expected an untrusted host to be rejected, got %v", err)
+	}
+
+	if _, err := trustMachine(dir, machine); err != nil {
+		t.Fatal(err)
+	}
+	output, err := runRemoteScript(t, context.Background(), dir, machine, "echo ok\n", nil, nil)
+	if err != nil || output != "ok\n" {
+		t.Fatalf("Expected the trusted host to run the script, got %q, %v", output, err)
+	}
+}
+
+func TestRemoteScriptKeyAuthentication(t *testing.T) {
+	dir, _ := setupSSHKeys(t)
+	_, other := setupSSHKeys(t)
+	machine := testMachine(t, startSSHServer(t, other))
+	if _, err := trustMachine(dir, machine); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := runRemoteScript(t, context.Background(), dir, machine, "echo ok\n", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Fatalf("Expected a key that is not authorized to be rejected, got %v", err)
+	}
+}
+
+func TestRemoteScriptHostKeyMismatch(t *testing.T) {
+	dir, key := setupSSHKeys(t)
+	first := testMachine(t, startSSHServer(t, key))
+	if _, err := trustMachine(dir, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Record the key of the first server for the address of the second, as
+	// if the key of the machine had changed since it was trusted
+	second := testMachine(t, startSSHServer(t, key))
+	data, err := ioutil.ReadFile(knownHostsPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), "]:"+first.Port, "]:"+second.Port, 1))
+	if err := ioutil.WriteFile(knownHostsPath(dir), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = runRemoteScript(t, context.Background(), dir, second, "echo ok\n", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Fatalf("Expected a changed host key to be rejected, got %v", err)
+	}
+	if _, err := trustMachine(dir, second); err == nil {
+		t.Fatal("Expected trusting a machine with a changed host key to fail")
+	}
+
+	first.HostKey = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	_, err = runRemoteScript(t, context.Background(), dir, first, "echo ok\n", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "does not match its HostKey") {
+		t.Fatalf("Expected a host key not matching HostKey to be rejected, got %v", err)
+	}
+}
+
+func TestToolKnownHosts(t *testing.T) {
+	dir, key := setupSSHKeys(t)
+	machine := testMachine(t, startSSHServer(t, key))
+
+	path, remove, err := toolKnownHosts(dir, machine)
+	if err != nil || path != knownHostsPath(dir) {
+		t.Fatalf("Expected a machine without HostKey to use the known_hosts file of the setup, got %s, %v", path, err)
+	}
+	remove()
+
+	hostKey, err := captureHostKey(machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.HostKey = ssh.FingerprintSHA256(hostKey)
+	path, remove, err = toolKnownHosts(dir, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net.JoinHostPort(machine.Address, machine.Port)
+	remote, _ := net.ResolveTCPAddr("tcp", address)
+	if err := callback(address, remote, hostKey); err != nil {
+		t.Fatalf("Expected the pinned host key to be known, got %v", err)
+	}
+	remove()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Expected the temporary known_hosts file to be removed")
+	}
+
+	machine.HostKey = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	if _, _, err := toolKnownHosts(dir, machine); err == nil || !strings.Contains(err.Error(), "does not match its HostKey") {
+		t.Fatalf("Expected a host key not matching HostKey to be rejected, got %v", err)
+	}
+}
+
+func TestRemoteScriptExitCode(t *testing.T) {
+	dir, key := setupSSHKeys(t)
+	machine := testMachine(t, startSSHServer(t, key))
+	if _, err := trustMachine(dir, machine); err != nil {
+		t.Fatal(err)
+	}
+
+	script := "echo \"$1|$version\"\nexit 3\n"
+	output, err := runRemoteScript(t, context.Background(), dir, machine, script, []string{"a b'c"}, []string{"version=1'2"})
+	if exitStatus(err) != 3 {
+		t.Fatalf("Expected exit status 3, got %v", err)
+	}
+	if output != "a b'c|1'2\n" {
+		t.Fatalf("Expected the arguments and environment to be passed, got %q", output)
+	}
+}
+
+func TestRemoteScriptCancel(t *testing.T) {
+	dir, key := setupSSHKeys(t)
+	machine := testMachine(t, startSSHServer(t, key))
+	if _, err := trustMachine(dir, machine); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runRemoteScript(t, ctx, dir, machine, "sleep 30\n", nil, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the script to be killed when the context is done, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the script to be killed promptly, took %s", elapsed)
+	}
+}
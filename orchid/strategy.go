@@ -0,0 +1,122 @@
+/*
+Definition of and methods for validating the strategies controlling how steps
+targeting a group or tag are rolled out across the machines
+*/
+
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+/*
+The types of strategies. Steps without a strategy run on all machines at once
+*/
+var strategyTypes = []string{"all", "rolling", "canary"}
+
+/*
+Type defining how a step is rolled out across the machines of a group or tag.
+The machines are run in batches: a single batch of all machines, batches of
+BatchSize machines, or a batch of Canaries machines followed by the rest. After
+each batch the health check is run on every machine of the batch, and the
+rollout waits for the pause before starting the next batch. The rollout is
+aborted once more than MaxFailures machines have failed
+*/
+type Strategy struct {
+	Type        string
+	BatchSize   int
+	Canaries    int
+	Pause       string
+	HealthCheck string
+	MaxFailures int
+}
+
+/*
+Get the number of machines in each batch of the rollout over the given number
+of machines
+*/
+func (s *Strategy) batches(machines int) []int {
+	if s == nil || machines == 0 {
+		return []int{machines}
+	}
+
+	switch s.Type {
+	case "rolling":
+		size := s.BatchSize
+		if size <= 0 {
+			size = 1
+		}
+		batches := []int{}
+		for machines > size {
+			batches = append(batches, size)
+			machines -= size
+		}
+		return append(batches, machines)
+	case "canary":
+		canaries := s.Canaries
+		if canaries <= 0 {
+			canaries = 1
+		}
+		if canaries >= machines {
+			return []int{machines}
+		}
+		return []int{canaries, machines - canaries}
+	}
+	return []int{machines}
+}
+
+/*
+Get the number of machines allowed to fail before the rollout is aborted
+*/
+func (s *Strategy) maxFailures() int {
+	if s == nil {
+		return 0
+	}
+	return s.MaxFailures
+}
+
+/*
+Get the duration to wait between batches
+*/
+func (s *Strategy) pause() time.Duration {
+	if s == nil {
+		return 0
+	}
+	pause, _ := parseDuration(s.Pause)
+	return pause
+}
+
+/*
+Validate the strategy of the step at the given path, which is described by the
+given name for use in messages
+*/
+func validateStrategy(v *Validator, at string, executable Executable, step string, scripts []string) {
+	strategy := executable.Strategy
+	if strategy == nil {
+		return
+	}
+
+	at = fieldPath(at, "Strategy")
+	if !isFanOut(executable.Machine) {
+		v.report(jobsFile, at, "", step+" must target a group or tag to have a Strategy")
+	}
+	if strategy.Type != "" && !contains(strategyTypes, strategy.Type) {
+		v.reportUnknown(jobsFile, fieldPath(at, "Type"), strategy.Type, step+" contains unknown strategy type '"+strategy.Type+"'", strategyTypes)
+	}
+	if strategy.BatchSize < 0 {
+		v.report(jobsFile, fieldPath(at, "BatchSize"), strconv.Itoa(strategy.BatchSize), step+" must not have a negative BatchSize")
+	}
+	if strategy.Canaries < 0 {
+		v.report(jobsFile, fieldPath(at, "Canaries"), strconv.Itoa(strategy.Canaries), step+" must not have a negative number of Canaries")
+	}
+	if strategy.MaxFailures < 0 {
+		v.report(jobsFile, fieldPath(at, "MaxFailures"), strconv.Itoa(strategy.MaxFailures), step+" must not have a negative MaxFailures")
+	}
+	if _, err := parseDuration(strategy.Pause); err != nil {
+		v.report(jobsFile, fieldPath(at, "Pause"), strategy.Pause, step+" must have a Pause that is a positive duration such as '5m', got '"+strategy.Pause+"'")
+	}
+	if strategy.HealthCheck != "" && !contains(scripts, strategy.HealthCheck) {
+		v.reportUnknown(jobsFile, fieldPath(at, "HealthCheck"), strategy.HealthCheck, step+" contains a reference to unknown health check script '"+strategy.HealthCheck+"'", scripts)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStrategyBatches(t *testing.T) {
+	cases := []struct {
+		strategy *Strategy
+		machines int
+		expected []int
+	}{
+		{nil, 4, []int{4}},
+		{&Strategy{Type: "rolling", BatchSize: 1}, 3, []int{1, 1, 1}},
+		{&Strategy{Type: "rolling", BatchSize: 2}, 5, []int{2, 2, 1}},
+		{&Strategy{Type: "rolling", BatchSize: 2}, 4, []int{2, 2}},
+		{&Strategy{Type: "rolling", BatchSize: 10}, 3, []int{3}},
+		{&Strategy{Type: "rolling"}, 2, []int{1, 1}},
+		{&Strategy{Type: "canary", Canaries: 2}, 5, []int{2, 3}},
+		{&Strategy{Type: "canary"}, 5, []int{1, 4}},
+		{&Strategy{Type: "canary", Canaries: 5}, 3, []int{3}},
+		{&Strategy{Type: "rolling", BatchSize: 2}, 0, []int{0}},
+	}
+	for _, c := range cases {
+		actual := c.strategy.batches(c.machines)
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("Expected %+v over %d machines to give batches %v, got %v", c.strategy, c.machines, c.expected, actual)
+		}
+	}
+}
+
+func TestStrategyDefaults(t *testing.T) {
+	var none *Strategy
+	if none.maxFailures() != 0 || none.pause() != 0 {
+		t.Fatal("Expected no strategy to allow no failures and not pause")
+	}
+
+	strategy := &Strategy{Type: "rolling", MaxFailures: 2, Pause: "1m30s"}
+	if strategy.maxFailures() != 2 {
+		t.Fatalf("Expected 2 failures to be allowed, got %d", strategy.maxFailures())
+	}
+	if strategy.pause().String() != "1m30s" {
+		t.Fatalf("Expected a pause of 1m30s, got %s", strategy.pause())
+	}
+}
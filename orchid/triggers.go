@@ -0,0 +1,285 @@
+/*
+Definition of and methods for loading and validating the triggers, which map
+events to the jobs the server runs when they occur
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/robfig/cron"
+	"github.com/yaccio/orchid/orchid/shared"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+/*
+The trigger type, which is shared with the server
+*/
+type Trigger = shared.Trigger
+
+/*
+The webhooks received by the server triggering a job
+*/
+type WebhookTrigger = shared.WebhookTrigger
+
+/*
+The schedule triggering a job
+*/
+type ScheduleTrigger = shared.ScheduleTrigger
+
+/*
+The completion of another job triggering a job
+*/
+type AfterTrigger = shared.AfterTrigger
+
+/*
+The changes to the files in a directory triggering a job
+*/
+type WatchTrigger = shared.WatchTrigger
+
+/*
+Type defining a schedule and the times it was last run and will run next
+*/
+type Schedule struct {
+	Trigger Trigger
+	Last    time.Time
+	Next    time.Time
+}
+
+/*
+Type defining a webhook triggering a job, as given in webhooks.json before
+webhooks became triggers. Such webhooks are still loaded as Webhook triggers
+*/
+type Webhook struct {
+	Repository string
+	Event      string
+	Branch     string
+	Job        string
+}
+
+/*
+The events of webhooks that can trigger a job
+*/
+var webhookEvents = []string{"push", "pull_request"}
+
+/*
+The statuses of completed jobs that can trigger a job
+*/
+var doneStatuses = []string{"Finished", "Error", "TimedOut", "Cancelled"}
+
+/*
+Validate the triggers, rejecting references to unknown jobs and triggers on the
+completion of jobs that would trigger each other endlessly
+*/
+func validateTriggers(v *Validator, triggers []Trigger, jobs []Job, actions []Action) {
+	jobIds := []string{}
+	jobsById := map[string]Job{}
+	for _, job := range jobs {
+		jobIds = append(jobIds, job.Id)
+		jobsById[job.Id] = job
+	}
+	actionIds := []string{}
+	for _, action := range actions {
+		actionIds = append(actionIds, action.Id)
+	}
+
+	for i, trigger := range triggers {
+		at := indexPath("", i)
+		if trigger.Action != "" {
+			if trigger.Job != "" || trigger.Schedule == nil {
+				v.report(triggersFile, fieldPath(at, "Action"), trigger.Action, "Trigger for action '"+trigger.Action+"' must be a Schedule trigger without a Job")
+			}
+			if v.loaded(actionsFile) && !contains(actionIds, trigger.Action) {
+				v.reportUnknown(triggersFile, fieldPath(at, "Action"), trigger.Action, "Trigger contains a reference to unknown action '"+trigger.Action+"'", actionIds)
+			}
+		} else if v.loaded(jobsFile) && !contains(jobIds, trigger.Job) {
+			v.reportUnknown(triggersFile, fieldPath(at, "Job"), trigger.Job, "Trigger contains a reference to unknown job '"+trigger.Job+"'", jobIds)
+		}
+
+		if job, exists := jobsById[trigger.Job]; exists {
+			names := []string{}
+			for _, parameter := range job.Parameters {
+				names = append(names, parameter.Name)
+			}
+			for _, name := range sortedKeys(trigger.Parameters) {
+				value := trigger.Parameters[name]
+				found := false
+				for _, parameter := range job.Parameters {
+					if parameter.Name == name {
+						found = true
+						if err := checkParameter(parameter, value); err != nil {
+							v.report(triggersFile, fieldPath(fieldPath(at, "Parameters"), name), value, "Trigger for "+trigger.Target()+" contains invalid parameter: "+err.Error())
+						}
+					}
+				}
+				if !found {
+					v.reportUnknown(triggersFile, fieldPath(fieldPath(at, "Parameters"), name), name, "Trigger for "+trigger.Target()+" contains unknown parameter '"+name+"'", names)
+				}
+			}
+		}
+
+		sources := 0
+		if trigger.Webhook != nil {
+			sources++
+			if trigger.Webhook.Event != "" && !contains(webhookEvents, trigger.Webhook.Event) {
+				v.reportUnknown(triggersFile, fieldPath(at, "Webhook.Event"), trigger.Webhook.Event, "Webhook trigger for job '"+trigger.Job+"' must have an Event that is either 'push' or 'pull_request', got '"+trigger.Webhook.Event+"'", webhookEvents)
+			}
+			if _, err := shared.BranchPattern(trigger.Webhook.Branch); err != nil {
+				v.report(triggersFile, fieldPath(at, "Webhook.Branch"), trigger.Webhook.Branch, "Webhook trigger for job '"+trigger.Job+"' must have a Branch that is a valid pattern, got '"+trigger.Webhook.Branch+"'")
+			}
+		}
+		if trigger.Schedule != nil {
+			sources++
+			if _, err := cron.ParseStandard(trigger.Schedule.Cron); err != nil {
+				v.report(triggersFile, fieldPath(at, "Schedule.Cron"), trigger.Schedule.Cron, "Schedule trigger for "+trigger.Target()+" must have a valid Cron expression: "+err.Error())
+			}
+			if _, err := time.LoadLocation(trigger.Schedule.Timezone); err != nil {
+				v.report(triggersFile, fieldPath(at, "Schedule.Timezone"), trigger.Schedule.Timezone, "Schedule trigger for "+trigger.Target()+" must have a valid Timezone: "+err.Error())
+			}
+			if trigger.Schedule.Missed != "" && trigger.Schedule.Missed != "skip" && trigger.Schedule.Missed != "catchup" {
+				v.reportUnknown(triggersFile, fieldPath(at, "Schedule.Missed"), trigger.Schedule.Missed, "Schedule trigger for "+trigger.Target()+" must have a Missed policy that is either 'skip' or 'catchup', got '"+trigger.Schedule.Missed+"'", []string{"skip", "catchup"})
+			}
+		}
+		if trigger.After != nil {
+			sources++
+			if v.loaded(jobsFile) && !contains(jobIds, trigger.After.Job) {
+				v.reportUnknown(triggersFile, fieldPath(at, "After.Job"), trigger.After.Job, "After trigger for job '"+trigger.Job+"' contains a reference to unknown job '"+trigger.After.Job+"'", jobIds)
+			}
+			if trigger.After.Status != "" && !contains(doneStatuses, trigger.After.Status) {
+				v.reportUnknown(triggersFile, fieldPath(at, "After.Status"), trigger.After.Status, "After trigger for job '"+trigger.Job+"' must have a Status that is either 'Finished', 'Error', 'TimedOut' or 'Cancelled', got '"+trigger.After.Status+"'", doneStatuses)
+			}
+		}
+		if trigger.Watch != nil {
+			sources++
+			if trigger.Watch.Directory == "" {
+				v.report(triggersFile, fieldPath(at, "Watch.Directory"), "", "Watch trigger for job '"+trigger.Job+"' must have a non-empty Directory")
+			}
+			if _, err := path.Match(trigger.Watch.Pattern, ""); err != nil {
+				v.report(triggersFile, fieldPath(at, "Watch.Pattern"), trigger.Watch.Pattern, "Watch trigger for job '"+trigger.Job+"' must have a Pattern that is a valid pattern, got '"+trigger.Watch.Pattern+"'")
+			}
+		}
+		if sources != 1 {
+			v.report(triggersFile, at, "", "Trigger for "+trigger.Target()+" must have exactly one of Webhook, Schedule, After and Watch")
+		}
+	}
+
+	// Depth first search for cycles of jobs triggering each other on
+	// completion, marking jobs as visiting while the jobs they trigger are
+	// searched, and as visited once they are done
+	triggered := map[string][]string{}
+	for _, trigger := range triggers {
+		if trigger.After != nil {
+			triggered[trigger.After.Job] = append(triggered[trigger.After.Job], trigger.Job)
+		}
+	}
+	const visiting, visited = 1, 2
+	state := map[string]int{}
+	var visit func(id string) bool
+	visit = func(id string) bool {
+		if state[id] == visiting {
+			return false
+		}
+		if state[id] == visited {
+			return true
+		}
+
+		state[id] = visiting
+		for _, next := range triggered[id] {
+			if !visit(next) {
+				return false
+			}
+		}
+		state[id] = visited
+		return true
+	}
+	for _, job := range jobs {
+		if !visit(job.Id) {
+			v.report(triggersFile, "", job.Id, "After triggers of job '"+job.Id+"' form a cycle")
+			return
+		}
+	}
+}
+
+/*
+Validate the webhooks given in webhooks.json, rejecting references to unknown
+jobs, and get the Webhook triggers they define
+*/
+func validateWebhooks(v *Validator, webhooks []Webhook, jobs []Job) []Trigger {
+	jobIds := []string{}
+	for _, job := range jobs {
+		jobIds = append(jobIds, job.Id)
+	}
+
+	triggers := []Trigger{}
+	for i, webhook := range webhooks {
+		at := indexPath("", i)
+		if v.loaded(jobsFile) && !contains(jobIds, webhook.Job) {
+			v.reportUnknown(webhooksFile, fieldPath(at, "Job"), webhook.Job, "Webhook contains a reference to unknown job '"+webhook.Job+"'", jobIds)
+		}
+		if webhook.Event != "" && !contains(webhookEvents, webhook.Event) {
+			v.reportUnknown(webhooksFile, fieldPath(at, "Event"), webhook.Event, "Webhook for job '"+webhook.Job+"' must have an Event that is either 'push' or 'pull_request', got '"+webhook.Event+"'", webhookEvents)
+		}
+		if _, err := shared.BranchPattern(webhook.Branch); err != nil {
+			v.report(webhooksFile, fieldPath(at, "Branch"), webhook.Branch, "Webhook for job '"+webhook.Job+"' must have a Branch that is a valid pattern, got '"+webhook.Branch+"'")
+		}
+		triggers = append(triggers, Trigger{
+			Job:     webhook.Job,
+			Webhook: &WebhookTrigger{Repository: webhook.Repository, Event: webhook.Event, Branch: webhook.Branch},
+		})
+	}
+	return triggers
+}
+
+/*
+Load the times the schedules were last run by the server. No times are returned
+if the server has not run any schedules
+*/
+func loadScheduleState(path string) (map[string]time.Time, error) {
+	state := map[string]time.Time{}
+	data, err := ioutil.ReadFile(path + "/schedules.state")
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+/*
+Get the schedule triggers with the times they were last run and will run next
+*/
+func loadSchedules(path string, triggers []Trigger, now time.Time) ([]Schedule, error) {
+	state, err := loadScheduleState(path)
+	if err != nil {
+		return []Schedule{}, err
+	}
+
+	schedules := []Schedule{}
+	for _, trigger := range triggers {
+		if trigger.Schedule == nil {
+			continue
+		}
+
+		parsed, err := cron.ParseStandard(trigger.Schedule.Cron)
+		if err != nil {
+			return []Schedule{}, err
+		}
+		location, err := trigger.Schedule.Location()
+		if err != nil {
+			return []Schedule{}, err
+		}
+
+		schedules = append(schedules, Schedule{
+			Trigger: trigger,
+			Last:    state[trigger.ScheduleKey()],
+			Next:    parsed.Next(now.In(location)),
+		})
+	}
+	return schedules, nil
+}
@@ -0,0 +1,584 @@
+/*
+Implementation of the validation of the configuration files, collecting every
+problem found rather than stopping at the first. Each problem is located by its
+file, the path of the offending value within the file and the line it is on
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Type defining a problem found in a configuration file. The path locates the
+offending value within the file, such as [0].Pipeline[1].Script, and the line
+is zero if it is not known. The suggestion is the value most likely meant, if a
+similar valid value exists
+*/
+type Problem struct {
+	File       string
+	Line       int    `json:",omitempty"`
+	Path       string `json:",omitempty"`
+	Value      string `json:",omitempty"`
+	Message    string
+	Suggestion string `json:",omitempty"`
+}
+
+/*
+Type defining the validation of the configuration files of a setup, holding
+the problems found so far and the lines of the values in each file loaded.
+Unknown fields are only reported by a strict validator, so files with fields
+Orchid does not know of can still be used
+*/
+type Validator struct {
+	path     string
+	strict   bool
+	files    map[string]string
+	lines    map[string]map[string]int
+	failed   map[string]bool
+	Problems []Problem
+}
+
+/*
+Type defining the error returned when the configuration has problems
+*/
+type ValidationError struct {
+	Problems []Problem
+}
+
+/*
+Format the problem as a single line starting with its location
+*/
+func (p Problem) String() string {
+	location := p.File
+	if p.Line > 0 {
+		location += ":" + strconv.Itoa(p.Line)
+	}
+	if p.Path != "" {
+		location += ": " + p.Path
+	}
+
+	text := location + ": " + p.Message
+	if p.Suggestion != "" {
+		text += " (did you mean '" + p.Suggestion + "'?)"
+	}
+	return text
+}
+
+/*
+Format the problems, one per line
+*/
+func (e ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "Config invalid: " + e.Problems[0].String()
+	}
+
+	lines := []string{"Config invalid: " + strconv.Itoa(len(e.Problems)) + " problems found"}
+	for _, problem := range e.Problems {
+		lines = append(lines, "  "+problem.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+/*
+Create a validator for the configuration files in the given directory
+*/
+func newValidator(path string) *Validator {
+	return &Validator{
+		path:   path,
+		files:  map[string]string{},
+		lines:  map[string]map[string]int{},
+		failed: map[string]bool{},
+	}
+}
+
+/*
+Get an error holding every problem found, or nil if none were found
+*/
+func (v *Validator) err() error {
+	if len(v.Problems) == 0 {
+		return nil
+	}
+	return ValidationError{Problems: v.Problems}
+}
+
+/*
+Load the configuration file with the given JSON file name into the value,
+reporting syntax errors, values of the wrong type and, if the validator is
+strict, unknown fields. The file may be written in YAML or TOML instead, in
+which case it is converted to JSON, but it must not exist in more than one
+format. If the file is optional it is not a problem for it not to exist.
+Returns whether the file exists and could be parsed
+*/
+func (v *Validator) load(file string, value interface{}, optional bool) bool {
+	variants := configVariants(v.path, file)
+	if len(variants) == 0 && optional {
+		return false
+	}
+	if len(variants) == 0 {
+		v.failed[file] = true
+		v.report(file, "", "", "Configuration file not found, expected "+file+" or a YAML or TOML variant of it")
+		return false
+	}
+	if len(variants) > 1 {
+		v.failed[file] = true
+		v.report(file, "", "", "Configuration given in more than one format: "+describeVariants(variants)+", remove all but one of them")
+		return false
+	}
+	v.files[file] = variants[0]
+
+	data, err := ioutil.ReadFile(v.path + "/" + variants[0])
+	if err != nil {
+		v.failed[file] = true
+		v.report(file, "", "", err.Error())
+		return false
+	}
+
+	isJSON := filepath.Ext(variants[0]) == ".json"
+	if isJSON {
+		v.lines[file] = jsonLines(data)
+	} else {
+		node, err := parseConfig(variants[0], data, file)
+		if err != nil {
+			v.failed[file] = true
+			v.Problems = append(v.Problems, Problem{File: variants[0], Line: tomlErrorLine(err), Message: "Invalid " + formatName(variants[0]) + ": " + err.Error()})
+			return false
+		}
+		v.lines[file] = yamlLines(node)
+
+		converted, err := nodeValue(node, reflect.TypeOf(value))
+		if err == nil {
+			data, err = json.Marshal(converted)
+		}
+		if err != nil {
+			v.failed[file] = true
+			v.report(file, "", "", "Invalid "+formatName(variants[0])+": "+err.Error())
+			return false
+		}
+	}
+
+	err = json.Unmarshal(data, value)
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		v.failed[file] = true
+		v.Problems = append(v.Problems, Problem{File: variants[0], Line: lineAt(data, syntaxErr.Offset), Message: "Invalid JSON: " + syntaxErr.Error()})
+		return false
+	}
+	if _, ok := err.(*json.UnmarshalTypeError); ok {
+		v.checkTypes(file, "", data, reflect.TypeOf(value))
+	} else if err != nil {
+		v.failed[file] = true
+		v.report(file, "", "", "Invalid JSON: "+err.Error())
+		return false
+	}
+
+	if v.strict {
+		var generic interface{}
+		json.Unmarshal(data, &generic)
+		v.checkFields(file, "", generic, reflect.TypeOf(value))
+	}
+	return true
+}
+
+/*
+Validate every configuration file in the given directory, including the
+optional server and general configuration
+*/
+func validateAll(path string) *Validator {
+	v := newValidator(path)
+	v.strict = true
+	validateSetup(v)
+
+	server := Server{}
+	if v.load(serverFile, &server, true) {
+		validateServer(v, server)
+	}
+	config := Config{}
+	if v.load(configFile, &config, true) {
+		validateConfig(v, config)
+	}
+	return v
+}
+
+/*
+Check whether the configuration file with the given name was loaded. References
+to the contents of files that could not be loaded are not checked, as they
+would all be reported as problems
+*/
+func (v *Validator) loaded(file string) bool {
+	return !v.failed[file]
+}
+
+/*
+Report a problem with the value at the given path of the file with the given
+JSON file name, which is reported under the name of the file actually loaded
+*/
+func (v *Validator) report(file, path, value, message string) {
+	name := file
+	if actual, exists := v.files[file]; exists {
+		name = actual
+	}
+
+	v.Problems = append(v.Problems, Problem{
+		File:    name,
+		Line:    v.line(file, path),
+		Path:    path,
+		Value:   value,
+		Message: message,
+	})
+}
+
+/*
+Report a problem with a value that should have been one of the candidates,
+suggesting the candidate most similar to it
+*/
+func (v *Validator) reportUnknown(file, path, value, message string, candidates []string) {
+	v.report(file, path, value, message)
+	v.Problems[len(v.Problems)-1].Suggestion = suggestion(value, candidates)
+}
+
+/*
+Get the line of the value at the given path of the file. If the value is not
+in the file, such as a missing field, the line of the closest enclosing value
+is used
+*/
+func (v *Validator) line(file, path string) int {
+	lines := v.lines[file]
+	path = strings.ToLower(path)
+	for {
+		if line, exists := lines[path]; exists {
+			return line
+		}
+
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return lines[""]
+		}
+		path = path[:i]
+	}
+}
+
+/*
+Report the fields of objects in a decoded JSON value that are not fields of the
+type they are decoded into, which would otherwise be ignored silently. Field
+names are matched regardless of case, as when decoding
+*/
+func (v *Validator) checkFields(file, path string, value interface{}, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		fields := map[string]reflect.StructField{}
+		names := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			fields[strings.ToLower(field.Name)] = field
+			names = append(names, field.Name)
+		}
+
+		for _, key := range sortedFields(object) {
+			field, exists := fields[strings.ToLower(key)]
+			if !exists {
+				v.reportUnknown(file, fieldPath(path, key), key, "Unknown field '"+key+"'", names)
+				continue
+			}
+			v.checkFields(file, fieldPath(path, key), object[key], field.Type)
+		}
+	case reflect.Slice:
+		array, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for i, element := range array {
+			v.checkFields(file, indexPath(path, i), element, t.Elem())
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, key := range sortedFields(object) {
+			v.checkFields(file, fieldPath(path, key), object[key], t.Elem())
+		}
+	}
+}
+
+/*
+Report every value of the wrong type in a JSON document decoded into a value of
+the given type. The decoder only returns the first value of the wrong type, so
+arrays, objects and fields are decoded one at a time until the values of the
+wrong type themselves are found
+*/
+func (v *Validator) checkTypes(file, path string, data []byte, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	err := json.Unmarshal(data, reflect.New(t).Interface())
+	typeErr, ok := err.(*json.UnmarshalTypeError)
+	if !ok {
+		return
+	}
+
+	before := len(v.Problems)
+	switch t.Kind() {
+	case reflect.Struct:
+		object := map[string]json.RawMessage{}
+		if json.Unmarshal(data, &object) != nil {
+			break
+		}
+		fields := map[string]reflect.StructField{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath == "" {
+				fields[strings.ToLower(field.Name)] = field
+			}
+		}
+		for _, key := range sortedRaw(object) {
+			if field, exists := fields[strings.ToLower(key)]; exists {
+				v.checkTypes(file, fieldPath(path, key), object[key], field.Type)
+			}
+		}
+	case reflect.Slice:
+		array := []json.RawMessage{}
+		if json.Unmarshal(data, &array) != nil {
+			break
+		}
+		for i, element := range array {
+			v.checkTypes(file, indexPath(path, i), element, t.Elem())
+		}
+	case reflect.Map:
+		object := map[string]json.RawMessage{}
+		if json.Unmarshal(data, &object) != nil {
+			break
+		}
+		for _, key := range sortedRaw(object) {
+			v.checkTypes(file, fieldPath(path, key), object[key], t.Elem())
+		}
+	}
+
+	// The value itself is of the wrong type if none of its elements are
+	if len(v.Problems) == before {
+		if field := typeErrorPath(typeErr.Field); field == "" || field[0] == '[' {
+			path += field
+		} else {
+			path = fieldPath(path, field)
+		}
+		v.report(file, path, "", "Must be of type "+typeErr.Type.String()+", got "+typeErr.Value)
+	}
+}
+
+/*
+Get the keys of an object of undecoded JSON values, sorted so problems are
+reported in the same order every time
+*/
+func sortedRaw(object map[string]json.RawMessage) []string {
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Get the name of the format of a configuration file, for use in messages
+*/
+func formatName(file string) string {
+	if filepath.Ext(file) == ".toml" {
+		return "TOML"
+	}
+	if filepath.Ext(file) == ".json" {
+		return "JSON"
+	}
+	return "YAML"
+}
+
+/*
+Get the path of a value of the wrong type as given by the JSON decoder, which
+separates indexes of arrays by dots as well, such as 0.Pipeline.1.Retries
+*/
+func typeErrorPath(field string) string {
+	path := ""
+	for _, part := range strings.Split(field, ".") {
+		if i, err := strconv.Atoi(part); err == nil {
+			path = indexPath(path, i)
+		} else {
+			path = fieldPath(path, part)
+		}
+	}
+	return path
+}
+
+/*
+Get the keys of a decoded JSON object, sorted so problems are reported in the
+same order every time
+*/
+func sortedFields(object map[string]interface{}) []string {
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Get the path of a field of the object at the given path
+*/
+func fieldPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+/*
+Get the path of an element of the array at the given path
+*/
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+/*
+Map the path of every value in a JSON document, in lower case, to the line it
+is on. Parsing stops at the first syntax error
+*/
+func jsonLines(data []byte) map[string]int {
+	lines := map[string]int{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		lines[strings.ToLower(path)] = lineAt(data, decoder.InputOffset())
+
+		switch token {
+		case json.Delim('{'):
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				err = walk(fieldPath(path, key.(string)))
+				if err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+		case json.Delim('['):
+			for i := 0; decoder.More(); i++ {
+				err = walk(indexPath(path, i))
+				if err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+		}
+		return err
+	}
+
+	walk("")
+	return lines
+}
+
+/*
+Get the line of the given byte offset of a document, counting from one
+*/
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 && data[offset-1] == '\n' {
+		offset--
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+/*
+Get the candidate most similar to the value, if any is similar enough to have
+likely been meant. Case is ignored when comparing
+*/
+func suggestion(value string, candidates []string) string {
+	best := ""
+	bestDistance := -1
+	for _, candidate := range candidates {
+		distance := editDistance(strings.ToLower(value), strings.ToLower(candidate))
+		if bestDistance < 0 || distance < bestDistance {
+			best = candidate
+			bestDistance = distance
+		}
+	}
+
+	if bestDistance < 0 || bestDistance >= len(value) || (bestDistance > 2 && bestDistance > len(value)/3) {
+		return ""
+	}
+	return best
+}
+
+/*
+Get the Levenshtein distance between two strings, being the number of single
+character insertions, deletions and substitutions turning one into the other
+*/
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+/*
+Get the smaller of two integers
+*/
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/*
+Check whether the value is one of the given values
+*/
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+/*
+Create a setup directory holding the given configuration files and an empty
+build.sh script
+*/
+func writeConfigs(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for _, sub := range []string{"scripts", "keys"} {
+		if err := os.MkdirAll(dir+"/"+sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(dir+"/scripts/build.sh", []byte("echo\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+/*
+Find the problem with the given message prefix, failing the test if there is
+none
+*/
+func findProblem(t *testing.T, problems []Problem, prefix string) Problem {
+	for _, problem := range problems {
+		if strings.HasPrefix(problem.Message, prefix) {
+			return problem
+		}
+	}
+	t.Fatalf("Expected a problem starting with %q, got %+v", prefix, problems)
+	return Problem{}
+}
+
+func TestValidationLines(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"machines.json": `[]`,
+		"actions.json":  `[]`,
+		"jobs.json": `[
+  {
+    "Id": "j",
+    "Timeout": "3 0m",
+    "Pipeline": [
+      {"Machine": "local", "Script": "biuld.sh"},
+      {
+        "Machine": "local",
+        "Script": "build.sh",
+        "Needs": ["0x"]
+      }
+    ]
+  }
+]`,
+		"triggers.json": `[
+  {
+    "Job": "ko",
+    "Schedule": {"Cron": "* * *"}
+  }
+]`,
+	})
+
+	v := newValidator(dir)
+	validateSetup(v)
+
+	cases := []struct {
+		prefix string
+		file   string
+		line   int
+	}{
+		{"Job 'j' must have a Timeout that is a positive duration", "jobs.json", 4},
+		{"Step '0' of job 'j' contains a reference to unknown script", "jobs.json", 6},
+		{"Step '1' of job 'j' needs unknown step", "jobs.json", 10},
+		{"Trigger contains a reference to unknown job 'ko'", "triggers.json", 3},
+		{"Schedule trigger for job 'ko' must have a valid Cron", "triggers.json", 4},
+	}
+	for _, c := range cases {
+		problem := findProblem(t, v.Problems, c.prefix)
+		if problem.File != c.file || problem.Line != c.line {
+			t.Errorf("Expected %q at %s:%d, got %s:%d", c.prefix, c.file, c.line, problem.File, problem.Line)
+		}
+	}
+
+	if problem := findProblem(t, v.Problems, "Step '0' of job 'j' contains a reference to unknown script"); problem.Suggestion != "build.sh" {
+		t.Errorf("Expected build.sh to be suggested, got %q", problem.Suggestion)
+	}
+}
+
+func TestValidationLinesYAML(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"machines.json": `[]`,
+		"actions.json":  `[]`,
+		"jobs.yaml": `- Id: j
+  Pipeline:
+    - Machine: local
+      Script: build.sh
+    - Machine: lcoal
+      Script: build.sh
+`,
+	})
+
+	v := newValidator(dir)
+	validateSetup(v)
+
+	problem := findProblem(t, v.Problems, "Step '1' of job 'j' contains a reference to unknown machine")
+	if problem.File != "jobs.yaml" || problem.Line != 5 {
+		t.Errorf("Expected the unknown machine at jobs.yaml:5, got %s:%d", problem.File, problem.Line)
+	}
+}
+
+func TestValidationSyntaxErrorLine(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"machines.json": `[]`,
+		"actions.json":  `[]`,
+		"jobs.json":     "[\n  {\"Id\": \"j\",\n  }\n]",
+	})
+
+	v := newValidator(dir)
+	validateSetup(v)
+
+	if len(v.Problems) != 1 || v.Problems[0].File != "jobs.json" || v.Problems[0].Line != 3 {
+		t.Fatalf("Expected a single syntax error at jobs.json:3, got %+v", v.Problems)
+	}
+}
+
+func TestValidationUnknownFieldsStrict(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"machines.json": `[]`,
+		"actions.json":  `[]`,
+		"jobs.json": `[
+  {
+    "Id": "j",
+    "Pipeline": [
+      {"Machine": "local", "Scirpt": "build.sh", "Script": "build.sh"}
+    ]
+  }
+]`,
+	})
+
+	v := newValidator(dir)
+	validateSetup(v)
+	if len(v.Problems) != 0 {
+		t.Fatalf("Expected unknown fields to be allowed when running jobs, got %+v", v.Problems)
+	}
+
+	v = newValidator(dir)
+	v.strict = true
+	validateSetup(v)
+	if len(v.Problems) != 1 || v.Problems[0].Line != 5 || v.Problems[0].Suggestion != "Script" {
+		t.Fatalf("Expected the unknown field to be reported at line 5, got %+v", v.Problems)
+	}
+}
+
+func TestValidationOptionalParameterDefaults(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"machines.json": `[]`,
+		"actions.json":  `[]`,
+		"jobs.json": `[
+  {
+    "Id": "j",
+    "Parameters": [
+      {"Name": "count", "Type": "int"},
+      {"Name": "deploy", "Type": "bool", "Default": "false"},
+      {"Name": "retries", "Type": "int", "Required": true},
+      {"Name": "environment", "Allowed": ["staging", "prod"]},
+      {"Name": "version"}
+    ],
+    "Pipeline": [
+      {"Machine": "local", "Script": "build.sh"}
+    ]
+  }
+]`,
+	})
+
+	v := newValidator(dir)
+	validateSetup(v)
+
+	for _, name := range []string{"count", "environment"} {
+		problem := findProblem(t, v.Problems, "Parameter '"+name+"' of job 'j' must have a Default or be Required")
+		if problem.File != "jobs.json" {
+			t.Errorf("Expected the missing Default of %s in jobs.json, got %s", name, problem.File)
+		}
+	}
+	if len(v.Problems) != 2 {
+		t.Errorf("Expected only the parameters count and environment to be reported, got %+v", v.Problems)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Writers used for the log output of pipelines, allowing several commands to
+write to the same log output file concurrently
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+/*
+Type defining a writer that can safely be shared between several goroutines
+*/
+type SyncWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+/*
+Type defining a writer prefixing every line written to it before passing it on
+to a shared writer. Only complete lines are passed on, ensuring lines from
+different writers are never interleaved
+*/
+type PrefixWriter struct {
+	mutex  sync.Mutex
+	prefix string
+	out    *SyncWriter
+	buffer []byte
+}
+
+/*
+Create a writer that can safely be shared between several goroutines
+*/
+func newSyncWriter(out io.Writer) *SyncWriter {
+	return &SyncWriter{out: out}
+}
+
+/*
+Write to the underlying writer
+*/
+func (w *SyncWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.out.Write(data)
+}
+
+/*
+Create a writer prefixing every line with the given prefix
+*/
+func newPrefixWriter(prefix string, out *SyncWriter) *PrefixWriter {
+	return &PrefixWriter{prefix: prefix, out: out}
+}
+
+/*
+Write to the underlying writer, holding back any incomplete line until it is
+completed or the writer is flushed
+*/
+func (w *PrefixWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buffer = append(w.buffer, data...)
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			break
+		}
+
+		_, err := w.out.Write(append([]byte(w.prefix), w.buffer[:i+1]...))
+		w.buffer = w.buffer[i+1:]
+		if err != nil {
+			return len(data), err
+		}
+	}
+
+	return len(data), nil
+}
+
+/*
+Write any incomplete line held back by the writer, terminating it
+*/
+func (w *PrefixWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.buffer) == 0 {
+		return nil
+	}
+
+	_, err := w.out.Write(append(append([]byte(w.prefix), w.buffer...), '\n'))
+	w.buffer = nil
+	return err
+}